@@ -1,6 +1,7 @@
 package adapters
 
 import (
+	"io"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,6 +15,10 @@ func (g *Gorilla) WriteMessage(messageType int, data []byte) error {
 	return g.conn.WriteMessage(messageType, data)
 }
 
+func (g *Gorilla) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	return g.conn.WritePreparedMessage(pm)
+}
+
 func (g *Gorilla) SetWriteDeadline(t time.Time) error {
 	return g.conn.SetWriteDeadline(t)
 }
@@ -42,6 +47,14 @@ func (g *Gorilla) ReadMessage() (int, []byte, error) {
 	return g.conn.ReadMessage()
 }
 
+func (g *Gorilla) NextReader() (int, io.Reader, error) {
+	return g.conn.NextReader()
+}
+
+func (g *Gorilla) NextWriter(messageType int) (io.WriteCloser, error) {
+	return g.conn.NextWriter(messageType)
+}
+
 func (g *Gorilla) Close() error {
 	return g.conn.Close()
 }
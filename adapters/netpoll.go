@@ -0,0 +1,376 @@
+package adapters
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/gorilla/websocket"
+)
+
+// ErrNetpollUnsupported means the event loop transport is not available on this platform.
+var ErrNetpollUnsupported = errors.New("netpoll is only supported on linux")
+
+// netpollChunk is the size of a single read of a connection served by Netpoll.
+const netpollChunk = 4096
+
+// NetpollSocket is a websocket connection upgraded by gobwas/ws and read by Netpoll.
+// It keeps no goroutine and no buffer of its own while the connection is idle.
+type NetpollSocket struct {
+	conn   net.Conn
+	raw    syscall.RawConn
+	fd     int
+	reader wsutil.Reader
+	limit  int64
+	poller poller
+
+	// readMutex is never contended since the socket is armed for a single event at a time,
+	// it orders the reads of consecutive events for the memory model
+	readMutex sync.Mutex
+	// buffer holds the bytes of a frame that is not complete yet, it is nil once the frames are handled
+	buffer []byte
+	// message collects the fragments of a message until its last frame
+	message     []byte
+	messageType ws.OpCode
+
+	// pending holds the bytes read with the handshake, they are read before the connection
+	pending *bytes.Reader
+
+	writeMutex sync.Mutex
+
+	pingHandler  func(string) error
+	pongHandler  func(string) error
+	closeHandler func(int, string) error
+
+	onMessage func(int, []byte)
+	onClose   func(error)
+
+	closed int32
+}
+
+// poller is the event loop a socket is registered with.
+type poller interface {
+	add(*NetpollSocket) error
+	rearm(*NetpollSocket) error
+	remove(*NetpollSocket)
+}
+
+func newNetpollSocket(conn net.Conn, pending []byte, p poller) *NetpollSocket {
+	n := &NetpollSocket{
+		conn:   conn,
+		poller: p,
+	}
+	var source io.Reader = conn
+	if len(pending) > 0 {
+		n.pending = bytes.NewReader(pending)
+		source = io.MultiReader(n.pending, conn)
+	}
+	n.reader = wsutil.Reader{
+		Source:    source,
+		State:     ws.StateServerSide,
+		CheckUTF8: true,
+		OnIntermediate: func(header ws.Header, payload io.Reader) error {
+			return n.control(header, payload)
+		},
+	}
+	return n
+}
+
+func (n *NetpollSocket) WriteMessage(messageType int, data []byte) error {
+	return n.writeFrame(ws.OpCode(messageType), data)
+}
+
+// NextWriter returns a writer sending every write as a fragment of one message, closing it sends the last fragment.
+// Control frames may be written between the fragments.
+func (n *NetpollSocket) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &fragmentWriter{socket: n, op: ws.OpCode(messageType)}, nil
+}
+
+func (n *NetpollSocket) writeFrame(op ws.OpCode, payload []byte) error {
+	return n.write(ws.Header{Fin: true, OpCode: op, Length: int64(len(payload))}, payload)
+}
+
+// write writes the header and the payload with a single writev, replies to control frames share the lock.
+func (n *NetpollSocket) write(h ws.Header, payload []byte) error {
+	var header bytes.Buffer
+	if err := ws.WriteHeader(&header, h); err != nil {
+		return err
+	}
+	buffers := net.Buffers{header.Bytes(), payload}
+	n.writeMutex.Lock()
+	defer n.writeMutex.Unlock()
+	_, err := buffers.WriteTo(n.conn)
+	return err
+}
+
+type fragmentWriter struct {
+	socket *NetpollSocket
+	op     ws.OpCode
+}
+
+func (f *fragmentWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := f.socket.write(ws.Header{OpCode: f.op, Length: int64(len(p))}, p); err != nil {
+		return 0, err
+	}
+	f.op = ws.OpContinuation
+	return len(p), nil
+}
+
+func (f *fragmentWriter) Close() error {
+	return f.socket.write(ws.Header{Fin: true, OpCode: f.op}, nil)
+}
+
+func (n *NetpollSocket) SetWriteDeadline(t time.Time) error {
+	return n.conn.SetWriteDeadline(t)
+}
+
+func (n *NetpollSocket) SetReadLimit(limit int64) {
+	n.limit = limit
+	n.reader.MaxFrameSize = limit
+}
+
+// SetReadDeadline does nothing, the reads of Netpoll never wait for data. A connection that stays silent
+// is ended by the timers of its session.
+func (n *NetpollSocket) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (n *NetpollSocket) SetPingHandler(h func(appData string) error) {
+	n.pingHandler = h
+}
+
+func (n *NetpollSocket) SetPongHandler(h func(appData string) error) {
+	n.pongHandler = h
+}
+
+func (n *NetpollSocket) SetCloseHandler(h func(code int, text string) error) {
+	n.closeHandler = h
+}
+
+// ReadMessage blocks until a data message is read, control frames are handled on the way.
+// Sessions served by Netpoll never call it, they are notified by Serve instead.
+func (n *NetpollSocket) ReadMessage() (int, []byte, error) {
+	for {
+		messageType, data, err := n.readFrame()
+		if err != nil || messageType != 0 {
+			return messageType, data, err
+		}
+	}
+}
+
+// readFrame reads the next frame, it returns a zero message type for control frames.
+func (n *NetpollSocket) readFrame() (int, []byte, error) {
+	header, err := n.reader.NextFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	if header.OpCode.IsControl() {
+		return 0, nil, n.control(header, &n.reader)
+	}
+	var payload io.Reader = &n.reader
+	if n.limit > 0 {
+		payload = io.LimitReader(payload, n.limit+1)
+	}
+	data, err := io.ReadAll(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n.limit > 0 && int64(len(data)) > n.limit {
+		return 0, nil, websocket.ErrReadLimit
+	}
+	return int(header.OpCode), data, nil
+}
+
+// control handles a ping, pong or close frame the way gorilla does.
+func (n *NetpollSocket) control(header ws.Header, r io.Reader) error {
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	switch header.OpCode {
+	case ws.OpPing:
+		if n.pingHandler != nil {
+			return n.pingHandler(string(payload))
+		}
+		return n.writeFrame(ws.OpPong, payload)
+	case ws.OpPong:
+		if n.pongHandler != nil {
+			return n.pongHandler(string(payload))
+		}
+	case ws.OpClose:
+		code, text := ws.ParseCloseFrameData(payload)
+		if code.Empty() {
+			code = ws.StatusNoStatusRcvd
+		}
+		if n.closeHandler != nil {
+			if err := n.closeHandler(int(code), text); err != nil {
+				return err
+			}
+		}
+		_ = n.writeFrame(ws.OpClose, ws.NewCloseFrameBody(ws.StatusNormalClosure, ""))
+		return &websocket.CloseError{Code: int(code), Text: text}
+	}
+	return nil
+}
+
+// Serve hands the socket to the event loop. onMessage is called by a worker for every data message
+// and onClose once when the connection ends.
+func (n *NetpollSocket) Serve(onMessage func(int, []byte), onClose func(error)) error {
+	n.onMessage = onMessage
+	n.onClose = onClose
+	return n.poller.add(n)
+}
+
+// readable is called by a worker when the connection has data. It reads what is available without blocking,
+// handles the complete frames and keeps the rest until the next event, so a client sending a frame slowly
+// never holds a worker.
+func (n *NetpollSocket) readable() {
+	n.readMutex.Lock()
+	defer n.readMutex.Unlock()
+	if n.hasPending() {
+		n.buffer, _ = io.ReadAll(n.pending)
+	}
+	for {
+		err := n.fill()
+		if err := n.parse(); err != nil {
+			n.end(err)
+			return
+		}
+		if err == errWouldBlock {
+			break
+		}
+		if err != nil {
+			n.end(err)
+			return
+		}
+	}
+	if len(n.buffer) == 0 {
+		n.buffer = nil
+	}
+	if err := n.poller.rearm(n); err != nil {
+		n.end(err)
+	}
+}
+
+// fill appends a chunk of the available bytes to the buffer.
+func (n *NetpollSocket) fill() error {
+	length := len(n.buffer)
+	if cap(n.buffer)-length < netpollChunk {
+		n.buffer = append(n.buffer, make([]byte, netpollChunk)...)
+	}
+	read, err := n.readAvailable(n.buffer[length:cap(n.buffer)])
+	n.buffer = n.buffer[:length+read]
+	return err
+}
+
+// parse handles the complete frames of the buffer and moves the incomplete rest to its start.
+func (n *NetpollSocket) parse() error {
+	offset := 0
+	for {
+		r := bytes.NewReader(n.buffer[offset:])
+		header, err := ws.ReadHeader(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := ws.CheckHeader(header, ws.StateServerSide); err != nil {
+			return err
+		}
+		// a frame too large is refused before its payload is buffered
+		if !header.OpCode.IsControl() && n.limit > 0 && int64(len(n.message))+header.Length > n.limit {
+			return websocket.ErrReadLimit
+		}
+		start := len(n.buffer) - r.Len()
+		if int64(r.Len()) < header.Length {
+			break
+		}
+		end := start + int(header.Length)
+		payload := n.buffer[start:end]
+		if header.Masked {
+			ws.Cipher(payload, header.Mask, 0)
+		}
+		offset = end
+		if err := n.frame(header, payload); err != nil {
+			return err
+		}
+	}
+	n.buffer = n.buffer[:copy(n.buffer, n.buffer[offset:])]
+	return nil
+}
+
+// frame handles a control frame or adds a data frame to its message, which is passed on once it is complete.
+func (n *NetpollSocket) frame(header ws.Header, payload []byte) error {
+	if header.OpCode.IsControl() {
+		return n.control(header, bytes.NewReader(payload))
+	}
+	switch {
+	case header.OpCode == ws.OpContinuation && n.messageType == 0:
+		return ws.ErrProtocolContinuationUnexpected
+	case header.OpCode != ws.OpContinuation && n.messageType != 0:
+		return ws.ErrProtocolContinuationExpected
+	case header.OpCode != ws.OpContinuation:
+		n.messageType = header.OpCode
+	}
+	// the buffer is reused, the message gets its own copy
+	n.message = append(n.message, payload...)
+	if !header.Fin {
+		return nil
+	}
+	messageType, message := n.messageType, n.message
+	n.messageType, n.message = 0, nil
+	if messageType == ws.OpText && !utf8.Valid(message) {
+		return wsutil.ErrInvalidUTF8
+	}
+	if message == nil {
+		message = []byte{}
+	}
+	n.onMessage(int(messageType), message)
+	return nil
+}
+
+// hasPending reports bytes read with the handshake, they do not wake the event loop.
+func (n *NetpollSocket) hasPending() bool {
+	return n.pending != nil && n.pending.Len() > 0
+}
+
+// end closes the connection and reports it once.
+func (n *NetpollSocket) end(err error) {
+	if !atomic.CompareAndSwapInt32(&n.closed, 0, 1) {
+		return
+	}
+	n.poller.remove(n)
+	_ = n.conn.Close()
+	if n.onClose != nil {
+		n.onClose(err)
+	}
+}
+
+// Close closes the connection. The onClose callback of Serve runs in its own goroutine,
+// since Close may be called while the session holds its locks.
+func (n *NetpollSocket) Close() error {
+	if !atomic.CompareAndSwapInt32(&n.closed, 0, 1) {
+		return nil
+	}
+	n.poller.remove(n)
+	err := n.conn.Close()
+	if n.onClose != nil {
+		go n.onClose(net.ErrClosed)
+	}
+	return err
+}
+
+// errWouldBlock means the connection has no more bytes to read for now.
+var errWouldBlock = errors.New("read would block")
@@ -0,0 +1,230 @@
+//go:build linux
+
+package adapters
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	netpollEvents = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLET | unix.EPOLLONESHOT
+	// netpollWait bounds a wait of the event loop, so it notices Close
+	netpollWait    = time.Second
+	netpollBacklog = 128
+)
+
+// Netpoll reads websocket connections with an edge-triggered epoll loop and a small pool of workers,
+// so an idle connection costs no goroutine. Every connection is armed for a single event at a time,
+// which keeps its frames in order without locking the reader.
+type Netpoll struct {
+	fd      int
+	sockets map[int]*NetpollSocket
+	mutex   sync.Mutex
+	ready   chan *NetpollSocket
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewNetpoll starts the event loop with the given number of read workers.
+func NewNetpoll(workers int) (*Netpoll, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Netpoll{
+		fd:      fd,
+		sockets: make(map[int]*NetpollSocket),
+		ready:   make(chan *NetpollSocket, netpollBacklog),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.loop()
+	return p, nil
+}
+
+// Upgrade upgrades the request with gobwas/ws, the returned socket is read once it is served.
+func (p *Netpoll) Upgrade(w http.ResponseWriter, r *http.Request) (*NetpollSocket, error) {
+	conn, rw, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return nil, err
+	}
+	raw, fd, err := socketFD(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	var pending []byte
+	if buffered := rw.Reader.Buffered(); buffered > 0 {
+		pending, _ = rw.Reader.Peek(buffered)
+		pending = append([]byte(nil), pending...)
+	}
+	socket := newNetpollSocket(conn, pending, p)
+	socket.raw = raw
+	socket.fd = fd
+	return socket, nil
+}
+
+// Close ends every connection and stops the event loop.
+func (p *Netpoll) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+		<-p.stopped
+		p.mutex.Lock()
+		sockets := make([]*NetpollSocket, 0, len(p.sockets))
+		for _, socket := range p.sockets {
+			sockets = append(sockets, socket)
+		}
+		p.mutex.Unlock()
+		for _, socket := range sockets {
+			socket.end(net.ErrClosed)
+		}
+		_ = unix.Close(p.fd)
+	})
+	return nil
+}
+
+func (p *Netpoll) add(socket *NetpollSocket) error {
+	fd := socket.fd
+	p.mutex.Lock()
+	p.sockets[fd] = socket
+	p.mutex.Unlock()
+	if socket.hasPending() {
+		if !p.dispatch(socket) {
+			return net.ErrClosed
+		}
+		return nil
+	}
+	if err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: netpollEvents, Fd: int32(fd)}); err != nil {
+		p.mutex.Lock()
+		delete(p.sockets, fd)
+		p.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// rearm waits for the next event of the socket, an edge that came in the meantime is reported right away.
+func (p *Netpoll) rearm(socket *NetpollSocket) error {
+	fd := socket.fd
+	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: netpollEvents, Fd: int32(fd)})
+	if errors.Is(err, unix.ENOENT) {
+		// the pending bytes of the handshake were read before the socket was added
+		err = unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: netpollEvents, Fd: int32(fd)})
+	}
+	return err
+}
+
+func (p *Netpoll) remove(socket *NetpollSocket) {
+	fd := socket.fd
+	p.mutex.Lock()
+	if p.sockets[fd] == socket {
+		delete(p.sockets, fd)
+		_ = unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil)
+	}
+	p.mutex.Unlock()
+}
+
+func (p *Netpoll) loop() {
+	defer close(p.stopped)
+	events := make([]unix.EpollEvent, netpollBacklog)
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		n, err := unix.EpollWait(p.fd, events, int(netpollWait/time.Millisecond))
+		if err != nil && err != unix.EINTR {
+			return
+		}
+		for i := 0; i < n; i++ {
+			p.mutex.Lock()
+			socket, ok := p.sockets[int(events[i].Fd)]
+			p.mutex.Unlock()
+			if ok {
+				p.dispatch(socket)
+			}
+		}
+	}
+}
+
+// dispatch hands the socket to a worker, returns false once the poller is closed. When all of them are busy
+// and the backlog is full the event loop waits, so the connections are read by the workers only and a flood of
+// events costs no goroutines. A socket waits for one worker at most, it is armed again once it was read.
+func (p *Netpoll) dispatch(socket *NetpollSocket) bool {
+	select {
+	case p.ready <- socket:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// work reads the dispatched sockets until the poller is closed, the sockets still in the backlog are ended by Close.
+func (p *Netpoll) work() {
+	for {
+		select {
+		case socket := <-p.ready:
+			socket.readable()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// socketFD returns the raw connection and its file descriptor, which stays valid until the connection is closed.
+func socketFD(conn net.Conn) (syscall.RawConn, int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, 0, errors.New("netpoll needs a raw network connection")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+	var fd int
+	if err := raw.Control(func(descriptor uintptr) {
+		fd = int(descriptor)
+	}); err != nil {
+		return nil, 0, err
+	}
+	return raw, fd, nil
+}
+
+// readAvailable reads the bytes the connection has without waiting for more, it returns errWouldBlock
+// once there are none.
+func (n *NetpollSocket) readAvailable(p []byte) (int, error) {
+	var read int
+	var readErr error
+	if err := n.raw.Read(func(fd uintptr) bool {
+		read, readErr = unix.Read(int(fd), p)
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	switch {
+	case readErr == unix.EAGAIN:
+		return 0, errWouldBlock
+	case readErr != nil:
+		return 0, readErr
+	case read == 0:
+		return 0, io.EOF
+	}
+	return read, nil
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+
+package adapters
+
+import (
+	"net/http"
+)
+
+// Netpoll is only available on linux, NewNetpoll returns ErrNetpollUnsupported elsewhere.
+type Netpoll struct{}
+
+func NewNetpoll(workers int) (*Netpoll, error) {
+	return nil, ErrNetpollUnsupported
+}
+
+func (p *Netpoll) Upgrade(w http.ResponseWriter, r *http.Request) (*NetpollSocket, error) {
+	return nil, ErrNetpollUnsupported
+}
+
+func (p *Netpoll) Close() error {
+	return nil
+}
+
+func (p *Netpoll) add(*NetpollSocket) error {
+	return ErrNetpollUnsupported
+}
+
+func (p *Netpoll) rearm(*NetpollSocket) error {
+	return ErrNetpollUnsupported
+}
+
+func (p *Netpoll) remove(*NetpollSocket) {}
+
+func (n *NetpollSocket) readAvailable([]byte) (int, error) {
+	return 0, ErrNetpollUnsupported
+}
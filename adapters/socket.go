@@ -1,6 +1,7 @@
 package adapters
 
 import (
+	"io"
 	"net/http"
 	"time"
 
@@ -27,6 +28,32 @@ type Socket interface {
 	Close() error
 }
 
+// PreparedWriter is implemented by sockets that can write a message framed once for many connections.
+// Broadcasts use it when the socket implements it and fall back to WriteMessage otherwise.
+type PreparedWriter interface {
+	WritePreparedMessage(*websocket.PreparedMessage) error
+}
+
+// StreamReader is implemented by sockets that can hand out the next data message as a reader
+// instead of reading it into a new slice, see config.WithPooledReads.
+// The reader is valid until NextReader is called again.
+type StreamReader interface {
+	NextReader() (int, io.Reader, error)
+}
+
+// StreamWriter is implemented by sockets that can write a message in fragments as it is produced.
+// The message ends when the writer is closed.
+type StreamWriter interface {
+	NextWriter(messageType int) (io.WriteCloser, error)
+}
+
+// EventSocket is read by an event loop instead of a goroutine blocked in ReadMessage, see Netpoll.
+// onMessage is called for every data message and onClose once when the connection ends.
+type EventSocket interface {
+	Socket
+	Serve(onMessage func(int, []byte), onClose func(error)) error
+}
+
 func NewGorillaSocket(w http.ResponseWriter, r *http.Request) (Socket, error) {
 	conn, err := upgrader.Upgrade(w, r, w.Header())
 	if err != nil {
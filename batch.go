@@ -0,0 +1,156 @@
+package soket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// JSONArrayEnvelope frames a batch as a JSON array of the messages, which must be JSON themselves.
+// It is the default of config.WithBatching for text messages.
+func JSONArrayEnvelope(messageType int, messages [][]byte) []byte {
+	size := len(messages) + 1
+	for _, message := range messages {
+		size += len(message)
+	}
+	frame := make([]byte, 0, size)
+	frame = append(frame, '[')
+	frame = append(frame, bytes.Join(messages, []byte{','})...)
+	return append(frame, ']')
+}
+
+// NewlineEnvelope frames a batch as the messages separated by new lines.
+func NewlineEnvelope(messageType int, messages [][]byte) []byte {
+	return bytes.Join(messages, []byte{'\n'})
+}
+
+// LengthPrefixedEnvelope frames a batch as the messages each prefixed with its length as a big endian uint32.
+func LengthPrefixedEnvelope(messageType int, messages [][]byte) []byte {
+	size := 4 * len(messages)
+	for _, message := range messages {
+		size += len(message)
+	}
+	frame := make([]byte, size)
+	offset := 0
+	for _, message := range messages {
+		binary.BigEndian.PutUint32(frame[offset:], uint32(len(message)))
+		offset += 4
+		offset += copy(frame[offset:], message)
+	}
+	return frame
+}
+
+// closedTick makes dequeue return immediately when the queues are empty.
+var closedTick = func() chan time.Time {
+	tick := make(chan time.Time)
+	close(tick)
+	return tick
+}()
+
+// batchable tells if the packet can be batched, streams, heartbeats and channel frames are written on their own
+// and binary messages are batched only with an envelope given to config.WithBatching.
+func (s *Session) batchable(pck *packet) bool {
+	if pck.stream != nil || pck.heartbeat || pck.channel {
+		return false
+	}
+	return pck.eType == websocket.TextMessage || (pck.eType == websocket.BinaryMessage && s.soket.Config.BatchEnvelope != nil)
+}
+
+// nextPacket returns the held packet first, then dequeues. While the client has no credits left,
+// see config.WithCredits, the next packet is held and only control packets are returned.
+func (s *Session) nextPacket(tick <-chan time.Time) (*packet, bool) {
+	pck := s.held
+	s.held = nil
+	if pck == nil {
+		var ok bool
+		if pck, ok = s.dequeue(tick); !ok || pck == nil {
+			return pck, ok
+		}
+	}
+	if s.admitted(pck) {
+		return pck, true
+	}
+	return s.dequeueControl(tick)
+}
+
+// collectBatch takes the packets of the same type that are queued behind the first one,
+// up to the limits of config.WithBatching, waiting at most BatchLinger for more.
+// A packet of another type is held for the next write.
+func (s *Session) collectBatch(first *packet) []*packet {
+	conf := s.soket.Config
+	batch := []*packet{first}
+	size := len(first.message)
+	var linger <-chan time.Time = closedTick
+	if conf.BatchLinger > 0 {
+		timer := time.NewTimer(conf.BatchLinger)
+		defer timer.Stop()
+		linger = timer.C
+	}
+	for len(batch) < conf.BatchMaxMessages && (conf.BatchMaxBytes <= 0 || size < conf.BatchMaxBytes) {
+		pck, ok := s.dequeue(linger)
+		if !ok || pck == nil {
+			break
+		}
+		if latest := s.latest(pck); latest.eType != first.eType || !s.batchable(&latest) {
+			s.held = pck
+			break
+		}
+		if !s.admitted(pck) {
+			break
+		}
+		if pck = s.prepare(pck); pck != nil {
+			batch = append(batch, pck)
+			size += len(pck.message)
+		}
+	}
+	return batch
+}
+
+// writeBatch writes the packets as a single message framed by config.WithBatching's envelope,
+// a batch of one packet is written as it is.
+func (s *Session) writeBatch(batch []*packet) error {
+	if len(batch) == 1 {
+		if err := s.writeMessage(batch[0]); err != nil {
+			s.undelivered(batch[0], writeError(err))
+			return err
+		}
+		return nil
+	}
+	messages := make([][]byte, len(batch))
+	for i, pck := range batch {
+		messages[i] = pck.message
+	}
+	envelope := s.soket.Config.BatchEnvelope
+	if envelope == nil {
+		envelope = JSONArrayEnvelope
+	}
+	eType := batch[0].eType
+	err := s.socketAdapter.SetWriteDeadline(time.Now().Add(s.soket.Config.WritePeriod))
+	if err == nil {
+		err = s.socketAdapter.WriteMessage(eType, envelope(eType, messages))
+	}
+	if err != nil {
+		for _, pck := range batch {
+			s.undelivered(pck, writeError(err))
+		}
+		return err
+	}
+	for _, pck := range batch {
+		s.sent(pck)
+	}
+	return nil
+}
+
+// dropHeld reports the held packet when the writer stops.
+func (s *Session) dropHeld() {
+	if s.held == nil {
+		return
+	}
+	pck := s.takeConflated(s.held)
+	s.held = nil
+	s.decreaseCounter()
+	s.charge(-int64(len(pck.message)))
+	s.undelivered(pck, ErrSessionClosed)
+}
@@ -0,0 +1,101 @@
+package soket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchEnvelopes(t *testing.T) {
+	messages := [][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)}
+	assert.Equal(t, `[{"a":1},{"b":2}]`, string(JSONArrayEnvelope(websocket.TextMessage, messages)))
+	assert.Equal(t, "{\"a\":1}\n{\"b\":2}", string(NewlineEnvelope(websocket.TextMessage, messages)))
+	assert.Equal(t, []byte{0, 0, 0, 1, 'x', 0, 0, 0, 2, 'y', 'z'},
+		LengthPrefixedEnvelope(websocket.BinaryMessage, [][]byte{[]byte("x"), []byte("yz")}))
+}
+
+type recordingAdapter struct {
+	mockAdapter
+	written []packet
+}
+
+func (r *recordingAdapter) WriteMessage(messageType int, data []byte) error {
+	r.written = append(r.written, packet{eType: messageType, message: data})
+	return nil
+}
+
+func TestWriteToSocketBatches(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.PingPeriod = time.Hour
+	s.Config.BatchMaxMessages = 2
+	var sent []string
+	s.handlers.sentTextMessageHandler = func(session *Session, message []byte) {
+		sent = append(sent, string(message))
+	}
+	s.handlers.sentBinaryMessageHandler = func(session *Session, message []byte) {
+		sent = append(sent, string(message))
+	}
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &recordingAdapter{}
+	session.socketAdapter = adapter
+
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("1")})
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("2")})
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("3")})
+	session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: []byte("4")})
+	close(session.messageQueue)
+	session.writeToSocket()
+
+	assert.Equal(t, []packet{
+		{eType: websocket.TextMessage, message: []byte("[1,2]")},
+		{eType: websocket.TextMessage, message: []byte("3")},
+		{eType: websocket.BinaryMessage, message: []byte("4")},
+	}, adapter.written)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, sent)
+	assert.Equal(t, int64(0), session.QueuedBytes())
+}
+
+func TestWriteToSocketBatchesBinaryWithEnvelope(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.PingPeriod = time.Hour
+	s.Config.BatchMaxMessages = 2
+	s.Config.BatchEnvelope = LengthPrefixedEnvelope
+	s.handlers.sentBinaryMessageHandler = func(session *Session, message []byte) {}
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &recordingAdapter{}
+	session.socketAdapter = adapter
+
+	session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: []byte("x")})
+	session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: []byte("yz")})
+	close(session.messageQueue)
+	session.writeToSocket()
+
+	assert.Equal(t, []packet{
+		{eType: websocket.BinaryMessage, message: LengthPrefixedEnvelope(websocket.BinaryMessage, [][]byte{[]byte("x"), []byte("yz")})},
+	}, adapter.written)
+}
+
+func TestWriteToSocketBatchByteLimit(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.PingPeriod = time.Hour
+	s.Config.BatchMaxMessages = 10
+	s.Config.BatchMaxBytes = 4
+	s.Config.BatchEnvelope = NewlineEnvelope
+	s.handlers.sentTextMessageHandler = func(session *Session, message []byte) {}
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &recordingAdapter{}
+	session.socketAdapter = adapter
+
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("ab")})
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("cd")})
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("ef")})
+	close(session.messageQueue)
+	session.writeToSocket()
+
+	assert.Equal(t, []packet{
+		{eType: websocket.TextMessage, message: []byte("ab\ncd")},
+		{eType: websocket.TextMessage, message: []byte("ef")},
+	}, adapter.written)
+}
@@ -0,0 +1,240 @@
+package soket
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// BroadcastOption changes how a broadcast is delivered, e.g. Retain or ConflationKey.
+type BroadcastOption func(*broadcastOptions)
+
+type broadcastOptions struct {
+	retain        int
+	retainFor     time.Duration
+	conflationKey string
+	ttl           time.Duration
+	priority      Priority
+}
+
+func loadBroadcastOptions(options []BroadcastOption) *broadcastOptions {
+	o := &broadcastOptions{}
+	for _, option := range options {
+		option(o)
+	}
+	return o
+}
+
+func (o *broadcastOptions) packet(eType int, message []byte) *packet {
+	pck := &packet{
+		eType:         eType,
+		message:       message,
+		conflationKey: o.conflationKey,
+		priority:      o.priority,
+	}
+	if o.ttl > 0 {
+		pck.expiresAt = time.Now().Add(o.ttl)
+	}
+	return pck
+}
+
+// DeliveryReport tells what happened to a broadcast.
+type DeliveryReport struct {
+	// Targeted is the number of sessions the message was addressed to.
+	Targeted int
+	// Enqueued is the number of sessions that accepted the message into their queue,
+	// including the ones that replaced a queued message with the same ConflationKey.
+	Enqueued int
+	// Dropped is the number of sessions skipped because their queue was full or the byte budgets were exceeded.
+	Dropped int
+	// Closed is the number of sessions skipped because they were already closed.
+	Closed int
+}
+
+func (r *DeliveryReport) add(other DeliveryReport) {
+	r.Targeted += other.Targeted
+	r.Enqueued += other.Enqueued
+	r.Dropped += other.Dropped
+	r.Closed += other.Closed
+}
+
+// BroadcastBuilder composes a broadcast step by step, nothing is sent until Send is called.
+//
+//	report, err := s.Broadcast(msg).Binary().ToTags("a", "b").Except(sender).Send(ctx)
+type BroadcastBuilder struct {
+	soket    *Soket
+	message  []byte
+	eType    int
+	all      bool
+	tags     []string
+	exprs    []TagExpr
+	topics   []string
+	sessions map[*Session]struct{}
+	except   map[*Session]struct{}
+	filters  []func(*Session) bool
+	options  []BroadcastOption
+	err      error
+}
+
+// Broadcast starts building a text broadcast for the message.
+func (s *Soket) Broadcast(message []byte) *BroadcastBuilder {
+	return &BroadcastBuilder{
+		soket:   s,
+		message: message,
+		eType:   websocket.TextMessage,
+	}
+}
+
+// Text sends the message as a text message, this is the default.
+func (b *BroadcastBuilder) Text() *BroadcastBuilder {
+	b.eType = websocket.TextMessage
+	return b
+}
+
+// Binary sends the message as a binary message.
+func (b *BroadcastBuilder) Binary() *BroadcastBuilder {
+	b.eType = websocket.BinaryMessage
+	return b
+}
+
+// With applies the options to the broadcast, retain options apply to the tags given with ToTags.
+func (b *BroadcastBuilder) With(options ...BroadcastOption) *BroadcastBuilder {
+	b.options = append(b.options, options...)
+	return b
+}
+
+// ToAll targets every registered session. This is the default if no other target is given.
+func (b *BroadcastBuilder) ToAll() *BroadcastBuilder {
+	b.all = true
+	return b
+}
+
+// ToTags targets the sessions having any of the tags.
+func (b *BroadcastBuilder) ToTags(tags ...string) *BroadcastBuilder {
+	b.tags = append(b.tags, tags...)
+	return b
+}
+
+// ToTagExpr targets the sessions matching the tag expression.
+func (b *BroadcastBuilder) ToTagExpr(expr TagExpr) *BroadcastBuilder {
+	b.exprs = append(b.exprs, expr)
+	return b
+}
+
+// ToTagQuery targets the sessions matching the tag expression string, see ParseTagExpr.
+// A malformed query is returned as an error from Send.
+func (b *BroadcastBuilder) ToTagQuery(query string) *BroadcastBuilder {
+	expr, err := ParseTagExpr(query)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	return b.ToTagExpr(expr)
+}
+
+// ToTopics targets the sessions subscribed to any of the topics, wildcard subscriptions included.
+func (b *BroadcastBuilder) ToTopics(topics ...string) *BroadcastBuilder {
+	b.topics = append(b.topics, topics...)
+	return b
+}
+
+// To targets the given sessions.
+func (b *BroadcastBuilder) To(sessions ...*Session) *BroadcastBuilder {
+	if b.sessions == nil {
+		b.sessions = make(map[*Session]struct{})
+	}
+	for _, session := range sessions {
+		b.sessions[session] = struct{}{}
+	}
+	return b
+}
+
+// Except removes the given sessions from the targets, e.g. the sender of a message.
+func (b *BroadcastBuilder) Except(sessions ...*Session) *BroadcastBuilder {
+	if b.except == nil {
+		b.except = make(map[*Session]struct{})
+	}
+	for _, session := range sessions {
+		b.except[session] = struct{}{}
+	}
+	return b
+}
+
+// Where keeps only the targets that match the filter. Multiple filters must all match.
+func (b *BroadcastBuilder) Where(filter func(*Session) bool) *BroadcastBuilder {
+	b.filters = append(b.filters, filter)
+	return b
+}
+
+// Send delivers the message to the selected sessions and reports the outcome.
+// An error is returned if a tag query is malformed or the context is done before every session is reached,
+// in which case the report counts the sessions reached so far. See config.WithFanOut for large broadcasts.
+func (b *BroadcastBuilder) Send(ctx context.Context) (DeliveryReport, error) {
+	if b.err != nil {
+		return DeliveryReport{}, b.err
+	}
+	if err := ctx.Err(); err != nil {
+		return DeliveryReport{}, err
+	}
+	options := loadBroadcastOptions(b.options)
+	if options.ttl == 0 {
+		options.ttl = b.soket.expiry.shortest(b.tags)
+	}
+	pck := options.packet(b.eType, b.message)
+	for _, tag := range b.tags {
+		b.soket.retained.retain(tag, pck, options)
+		b.soket.recordHistory(tag, pck)
+	}
+	return b.soket.haus.deliver(ctx, b.recipients(), pck)
+}
+
+// SendAsync sends like Send without blocking the caller, the future resolves to the report.
+func (b *BroadcastBuilder) SendAsync(ctx context.Context) *BroadcastFuture {
+	future := &BroadcastFuture{done: make(chan struct{})}
+	go func() {
+		defer close(future.done)
+		future.report, future.err = b.Send(ctx)
+	}()
+	return future
+}
+
+// recipients resolves the targets into a set of sessions.
+func (b *BroadcastBuilder) recipients() map[*Session]struct{} {
+	h := b.soket.haus
+	if b.all || (len(b.tags) == 0 && len(b.exprs) == 0 && len(b.topics) == 0 && b.sessions == nil) {
+		return h.filterSessions(b.matches)
+	}
+	sessions := h.filterSessionsByTags(b.tags)
+	for _, expr := range b.exprs {
+		for session := range h.filterSessionsByTagExpr(expr) {
+			sessions[session] = struct{}{}
+		}
+	}
+	for _, topic := range b.topics {
+		for session := range h.filterSessionsByTopic(topic) {
+			sessions[session] = struct{}{}
+		}
+	}
+	for session := range b.sessions {
+		sessions[session] = struct{}{}
+	}
+	for session := range sessions {
+		if !b.matches(session) {
+			delete(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func (b *BroadcastBuilder) matches(session *Session) bool {
+	if _, ok := b.except[session]; ok {
+		return false
+	}
+	for _, filter := range b.filters {
+		if !filter(session) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package soket
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newBroadcastTestSoket() *Soket {
+	conf := &config.Config{MessageQueueSize: 5}
+	handlers := &handlers{
+		logHandler:         func(s *Session, log string) {},
+		errorHandler:       func(s *Session, err error) {},
+		deadLetterHandler:  func(string, InboxMessage, error) {},
+		undeliveredHandler: func(*Session, Message, error) {},
+	}
+	return &Soket{
+		Config:   conf,
+		haus:     newHaus(conf, handlers),
+		handlers: handlers,
+		retained: newRetainStore(),
+		history:  newHistory(),
+		inbox:    newInbox(),
+		expiry:   newExpiry(),
+		grace: grace{
+			waitGroup: &sync.WaitGroup{},
+		},
+	}
+}
+
+func newBroadcastTestSession(s *Soket, id string, queueSize int, tags ...string) *Session {
+	session := &Session{
+		id:           id,
+		soket:        s,
+		messageQueue: make(chan *packet, queueSize),
+		highQueue:    make(chan *packet, queueSize),
+		controlQueue: make(chan *packet, queueSize),
+	}
+	tagSet := make(map[string]struct{})
+	for _, tag := range tags {
+		tagSet[tag] = struct{}{}
+	}
+	s.haus.registerSession(session, tagSet)
+	return session
+}
+
+func TestBroadcastBuilderToTagsExcept(t *testing.T) {
+	s := newBroadcastTestSoket()
+	sender := newBroadcastTestSession(s, "sender", 5, "a")
+	other := newBroadcastTestSession(s, "other", 5, "b")
+	both := newBroadcastTestSession(s, "both", 5, "a", "b")
+	newBroadcastTestSession(s, "outsider", 5, "c")
+
+	report, err := s.Broadcast([]byte("msg")).Binary().ToTags("a", "b").Except(sender).Send(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Targeted: 2, Enqueued: 2}, report)
+
+	pck := <-other.messageQueue
+	assert.Equal(t, websocket.BinaryMessage, pck.eType)
+	assert.Equal(t, []byte("msg"), pck.message)
+	assert.Len(t, both.messageQueue, 1)
+	assert.Len(t, sender.messageQueue, 0)
+}
+
+func TestBroadcastBuilderWhere(t *testing.T) {
+	s := newBroadcastTestSoket()
+	first := newBroadcastTestSession(s, "1", 5)
+	newBroadcastTestSession(s, "2", 5)
+
+	report, err := s.Broadcast([]byte("msg")).Where(func(session *Session) bool {
+		return session.GetID() == "1"
+	}).Send(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Targeted: 1, Enqueued: 1}, report)
+	assert.Equal(t, websocket.TextMessage, (<-first.messageQueue).eType)
+}
+
+func TestBroadcastBuilderReport(t *testing.T) {
+	s := newBroadcastTestSoket()
+	newBroadcastTestSession(s, "ok", 5)
+	newBroadcastTestSession(s, "full", 0)
+	closed := newBroadcastTestSession(s, "closed", 5)
+	closed.closed = true
+
+	report, err := s.Broadcast([]byte("msg")).ToAll().Send(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Targeted: 3, Enqueued: 1, Dropped: 1, Closed: 1}, report)
+}
+
+func TestBroadcastBuilderCancelledContext(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := s.Broadcast([]byte("msg")).To(session).Send(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, DeliveryReport{}, report)
+	assert.Len(t, session.messageQueue, 0)
+}
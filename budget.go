@@ -0,0 +1,45 @@
+package soket
+
+import (
+	"sync/atomic"
+
+	"github.com/soket/config"
+)
+
+// admit checks the byte budgets before queueing the packet, see config.WithByteBudgets.
+// Budgets are checked and charged separately, concurrent sends may go slightly over them.
+func (s *Session) admit(pck *packet) error {
+	conf := s.soket.Config
+	size := int64(len(pck.message))
+	overSession := conf.SessionByteBudget > 0 && atomic.LoadInt64(&s.queuedBytes)+size > conf.SessionByteBudget
+	overGlobal := conf.GlobalByteBudget > 0 && atomic.LoadInt64(&s.soket.metrics.queuedBytes)+size > conf.GlobalByteBudget
+	if !overSession && !overGlobal {
+		return nil
+	}
+	switch conf.BudgetPolicy {
+	case config.BudgetDropNormal:
+		if pck.priority != PriorityNormal {
+			return nil
+		}
+	case config.BudgetDisconnect:
+		if overSession {
+			s.soket.handlers.logHandler(s, "DISCONNECTING_OVER_BUDGET_SESSION")
+			// reading fails after this, which closes the session
+			if err := s.socketAdapter.Close(); err != nil {
+				s.soket.handlers.errorHandler(s, err)
+			}
+		}
+	}
+	return ErrBudgetExceeded
+}
+
+// charge adds the bytes to the queued bytes of the session and of the soket, negative to release them.
+func (s *Session) charge(bytes int64) {
+	atomic.AddInt64(&s.queuedBytes, bytes)
+	atomic.AddInt64(&s.soket.metrics.queuedBytes, bytes)
+}
+
+// QueuedBytes returns the size of the messages waiting in the queues of the session.
+func (s *Session) QueuedBytes() int64 {
+	return atomic.LoadInt64(&s.queuedBytes)
+}
@@ -0,0 +1,101 @@
+package soket
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionByteBudget(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.SessionByteBudget = 10
+	var undelivered []error
+	s.HandleUndelivered(func(session *Session, message Message, err error) {
+		undelivered = append(undelivered, err)
+	})
+	session := newBroadcastTestSession(s, "1", 5)
+	other := newBroadcastTestSession(s, "2", 5)
+
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 6)}))
+	assert.Equal(t, ErrBudgetExceeded, session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 6)}))
+	assert.Nil(t, other.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 6)}))
+	assert.Len(t, undelivered, 1)
+	assert.True(t, errors.Is(undelivered[0], ErrBudgetExceeded))
+
+	assert.Equal(t, int64(6), session.QueuedBytes())
+	assert.Equal(t, int64(12), s.Metrics().QueuedBytes)
+
+	session.socketAdapter = &mockAdapter{}
+	session.close()
+	assert.Equal(t, int64(0), session.QueuedBytes())
+	assert.Equal(t, int64(6), s.Metrics().QueuedBytes)
+}
+
+func TestGlobalByteBudgetDropNormal(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.GlobalByteBudget = 10
+	s.Config.BudgetPolicy = config.BudgetDropNormal
+	session := newBroadcastTestSession(s, "1", 5)
+
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 8)}))
+	assert.Equal(t, ErrBudgetExceeded, session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 8)}))
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 8), priority: PriorityHigh}))
+	assert.Equal(t, int64(16), s.Metrics().QueuedBytes)
+}
+
+func TestBroadcastOverBudget(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.SessionByteBudget = 10
+	full := newBroadcastTestSession(s, "full", 5, "room")
+	newBroadcastTestSession(s, "empty", 5, "room")
+	assert.Nil(t, full.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 8)}))
+
+	report := s.haus.broadcastTo(s.haus.filterSessionsByTag("room"), &packet{eType: websocket.BinaryMessage, message: make([]byte, 4)})
+	assert.Equal(t, DeliveryReport{Targeted: 2, Enqueued: 1, Dropped: 1}, report)
+}
+
+func TestByteBudgetConflation(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 5)
+
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: make([]byte, 4), conflationKey: "key"}))
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: make([]byte, 9), conflationKey: "key"}))
+	assert.Equal(t, int64(9), session.QueuedBytes())
+}
+
+type closeCountingAdapter struct {
+	mockAdapter
+	mutex  sync.Mutex
+	closed int
+}
+
+func (c *closeCountingAdapter) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed++
+	return nil
+}
+
+func (c *closeCountingAdapter) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func TestByteBudgetDisconnect(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.SessionByteBudget = 10
+	s.Config.BudgetPolicy = config.BudgetDisconnect
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &closeCountingAdapter{}
+	session.socketAdapter = adapter
+
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 10)}))
+	assert.Equal(t, 0, adapter.count())
+	assert.Equal(t, ErrBudgetExceeded, session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: make([]byte, 1)}))
+	assert.Equal(t, 1, adapter.count())
+}
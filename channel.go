@@ -0,0 +1,352 @@
+package soket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frames of the channel protocol are binary messages starting with the frame type and the channel id
+// as a big endian uint32, see config.WithChannels.
+//
+//	open    the payload is the name of the channel, the peer answers with accept or reset
+//	accept  the channel is open
+//	data    the payload is data of the channel, at most the window granted by the peer
+//	window  the payload is a big endian uint32 of bytes the sender may send in addition
+//	close   the sender will not write anymore, the peer reads io.EOF after the data already received
+//	reset   the channel is gone, the payload tells why
+const (
+	channelOpen byte = iota + 1
+	channelAccept
+	channelData
+	channelWindow
+	channelClose
+	channelReset
+)
+
+const channelHeaderSize = 5
+
+// ChannelHandler serves a channel opened by a client, see HandleChannel. It runs in its own goroutine.
+type ChannelHandler func(*Session, *Channel)
+
+// Channel is a logical stream multiplexed over the connection of a session, with its own flow control.
+// Clients open channels with odd ids, the server with even ids.
+type Channel struct {
+	id      uint32
+	name    string
+	session *Session
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	received bytes.Buffer
+	// consumed counts the bytes read since the last window frame
+	consumed   int
+	sendWindow int
+	// readClosed is set once the peer closed the channel, writeClosed once Close was called
+	readClosed  bool
+	writeClosed bool
+	err         error
+
+	// accepted gets the answer of the client to OpenChannel
+	accepted chan error
+}
+
+func newChannel(session *Session, id uint32, name string) *Channel {
+	c := &Channel{
+		id:         id,
+		name:       name,
+		session:    session,
+		sendWindow: session.soket.Config.ChannelWindow,
+		accepted:   make(chan error, 1),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// ID returns the id of the channel, unique within its session.
+func (c *Channel) ID() uint32 {
+	return c.id
+}
+
+// Name returns the name the channel was opened with.
+func (c *Channel) Name() string {
+	return c.name
+}
+
+// Session returns the session carrying the channel.
+func (c *Channel) Session() *Session {
+	return c.session
+}
+
+// Read reads the data received on the channel, it returns io.EOF once the peer closed the channel
+// and the data received before is read.
+func (c *Channel) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	for c.received.Len() == 0 && !c.readClosed && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.received.Len() == 0 {
+		err := c.err
+		if err == nil {
+			err = io.EOF
+		}
+		c.mutex.Unlock()
+		return 0, err
+	}
+	n, _ := c.received.Read(p)
+	c.consumed += n
+	// the peer may send again what was read, once it is worth a frame
+	var grant int
+	if c.consumed >= c.session.soket.Config.ChannelWindow/2 && !c.readClosed {
+		grant, c.consumed = c.consumed, 0
+	}
+	c.mutex.Unlock()
+	if grant > 0 {
+		var increment [4]byte
+		binary.BigEndian.PutUint32(increment[:], uint32(grant))
+		if err := c.session.sendChannelFrame(channelWindow, c.id, increment[:]); err != nil {
+			c.reset(err)
+		}
+	}
+	return n, nil
+}
+
+// Write sends p in data frames, blocking while the window granted by the peer is used up.
+func (c *Channel) Write(p []byte) (int, error) {
+	frameSize := c.session.soket.Config.ChannelFrameSize
+	written := 0
+	for len(p) > 0 {
+		c.mutex.Lock()
+		for c.sendWindow == 0 && c.err == nil && !c.writeClosed {
+			c.cond.Wait()
+		}
+		switch {
+		case c.err != nil:
+			err := c.err
+			c.mutex.Unlock()
+			return written, err
+		case c.writeClosed:
+			c.mutex.Unlock()
+			return written, ErrChannelClosed
+		}
+		n := len(p)
+		if n > c.sendWindow {
+			n = c.sendWindow
+		}
+		if n > frameSize {
+			n = frameSize
+		}
+		c.sendWindow -= n
+		c.mutex.Unlock()
+		if err := c.session.sendChannelFrame(channelData, c.id, p[:n]); err != nil {
+			c.reset(err)
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close tells the peer that nothing more will be written, the data it sends can still be read.
+// The channel is released once both sides closed it.
+func (c *Channel) Close() error {
+	c.mutex.Lock()
+	if c.writeClosed || c.err != nil {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.writeClosed = true
+	done := c.readClosed
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+	err := c.session.sendChannelFrame(channelClose, c.id, nil)
+	if done || err != nil {
+		c.session.releaseChannel(c)
+	}
+	return err
+}
+
+// reset ends the channel with the error, readers and writers waiting on it return it.
+func (c *Channel) reset(err error) {
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+	select {
+	case c.accepted <- err:
+	default:
+	}
+	c.session.releaseChannel(c)
+}
+
+// HandleChannel registers the handler of the channels the clients open with the name, see config.WithChannels.
+// Channels with a name without a handler are refused.
+func (s *Soket) HandleChannel(name string, f ChannelHandler) {
+	if s.handlers.channelHandlers == nil {
+		s.handlers.channelHandlers = make(map[string]ChannelHandler)
+	}
+	s.handlers.channelHandlers[name] = f
+}
+
+// OpenChannel opens a channel to the client and waits until the client accepts it.
+func (s *Session) OpenChannel(ctx context.Context, name string) (*Channel, error) {
+	if s.soket.Config.ChannelWindow <= 0 {
+		return nil, errors.New("channels are not configured")
+	}
+	s.channelsMutex.Lock()
+	if s.channels == nil {
+		s.channels = make(map[uint32]*Channel)
+	}
+	if len(s.channels) >= s.soket.Config.MaxChannels {
+		s.channelsMutex.Unlock()
+		return nil, ErrChannelLimit
+	}
+	s.lastChannelID += 2
+	c := newChannel(s, s.lastChannelID, name)
+	s.channels[c.id] = c
+	s.channelsMutex.Unlock()
+	if err := s.sendChannelFrame(channelOpen, c.id, []byte(name)); err != nil {
+		c.reset(err)
+		return nil, err
+	}
+	select {
+	case err := <-c.accepted:
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		c.reset(ctx.Err())
+		_ = s.sendChannelFrame(channelReset, c.id, []byte(ctx.Err().Error()))
+		return nil, ctx.Err()
+	}
+}
+
+// receivedChannelFrame handles a binary message of the channel protocol.
+func (s *Session) receivedChannelFrame(frame []byte) {
+	if len(frame) < channelHeaderSize {
+		s.soket.handlers.errorHandler(s, errors.New("channel frame is too short"))
+		return
+	}
+	kind, id, payload := frame[0], binary.BigEndian.Uint32(frame[1:]), frame[channelHeaderSize:]
+	if kind == channelOpen {
+		s.acceptChannel(id, string(payload))
+		return
+	}
+	s.channelsMutex.Lock()
+	c := s.channels[id]
+	s.channelsMutex.Unlock()
+	if c == nil {
+		if kind != channelReset {
+			_ = s.sendChannelFrame(channelReset, id, []byte(ErrChannelClosed.Error()))
+		}
+		return
+	}
+	switch kind {
+	case channelAccept:
+		select {
+		case c.accepted <- nil:
+		default:
+		}
+	case channelData:
+		c.mutex.Lock()
+		overflow := c.received.Len()+len(payload) > s.soket.Config.ChannelWindow
+		if !overflow && !c.readClosed {
+			// the message may be a pooled buffer, the data is copied
+			c.received.Write(payload)
+			c.cond.Broadcast()
+		}
+		c.mutex.Unlock()
+		if overflow {
+			c.reset(ErrChannelWindow)
+			_ = s.sendChannelFrame(channelReset, id, []byte(ErrChannelWindow.Error()))
+		}
+	case channelWindow:
+		if len(payload) == 4 {
+			c.mutex.Lock()
+			c.sendWindow += int(binary.BigEndian.Uint32(payload))
+			c.cond.Broadcast()
+			c.mutex.Unlock()
+		}
+	case channelClose:
+		c.mutex.Lock()
+		c.readClosed = true
+		done := c.writeClosed
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+		if done {
+			s.releaseChannel(c)
+		}
+	case channelReset:
+		c.reset(ErrChannelReset)
+	}
+}
+
+// acceptChannel opens a channel for the client if a handler serves its name and the session is below
+// its channel limit, otherwise it is reset.
+func (s *Session) acceptChannel(id uint32, name string) {
+	handler, ok := s.soket.handlers.channelHandlers[name]
+	if !ok || id%2 == 0 {
+		_ = s.sendChannelFrame(channelReset, id, []byte(ErrChannelRefused.Error()))
+		return
+	}
+	s.channelsMutex.Lock()
+	if s.channels == nil {
+		s.channels = make(map[uint32]*Channel)
+	}
+	if _, taken := s.channels[id]; taken {
+		s.channelsMutex.Unlock()
+		_ = s.sendChannelFrame(channelReset, id, []byte(ErrChannelRefused.Error()))
+		return
+	}
+	if len(s.channels) >= s.soket.Config.MaxChannels {
+		s.channelsMutex.Unlock()
+		_ = s.sendChannelFrame(channelReset, id, []byte(ErrChannelLimit.Error()))
+		return
+	}
+	c := newChannel(s, id, name)
+	s.channels[id] = c
+	s.channelsMutex.Unlock()
+	if err := s.sendChannelFrame(channelAccept, id, nil); err != nil {
+		c.reset(err)
+		return
+	}
+	go handler(s, c)
+}
+
+func (s *Session) releaseChannel(c *Channel) {
+	s.channelsMutex.Lock()
+	if s.channels[c.id] == c {
+		delete(s.channels, c.id)
+	}
+	s.channelsMutex.Unlock()
+}
+
+// resetChannels ends the channels of a closing session.
+func (s *Session) resetChannels() {
+	s.channelsMutex.Lock()
+	channels := make([]*Channel, 0, len(s.channels))
+	for _, c := range s.channels {
+		channels = append(channels, c)
+	}
+	s.channelsMutex.Unlock()
+	for _, c := range channels {
+		c.reset(ErrSessionClosed)
+	}
+}
+
+func (s *Session) sendChannelFrame(kind byte, id uint32, payload []byte) error {
+	frame := make([]byte, channelHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[channelHeaderSize:], payload)
+	return s.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: frame, channel: true})
+}
@@ -0,0 +1,211 @@
+package soket
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeChannelFrame(t *testing.T, conn *websocket.Conn, kind byte, id uint32, payload []byte) {
+	frame := append([]byte{kind, 0, 0, 0, 0}, payload...)
+	binary.BigEndian.PutUint32(frame[1:], id)
+	assert.Nil(t, conn.WriteMessage(websocket.BinaryMessage, frame))
+}
+
+func readChannelFrame(t *testing.T, conn *websocket.Conn) (byte, uint32, []byte) {
+	messageType, frame, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	if len(frame) < channelHeaderSize {
+		t.Fatal("not a channel frame")
+	}
+	return frame[0], binary.BigEndian.Uint32(frame[1:]), frame[channelHeaderSize:]
+}
+
+func windowFrame(increment uint32) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, increment)
+	return payload
+}
+
+func TestChannelOpenedByClient(t *testing.T) {
+	s := New(config.WithChannels(64, 16, 8)).(*Soket)
+	defer close(s.done)
+	s.HandleChannel("echo", func(session *Session, c *Channel) {
+		assert.Equal(t, "echo", c.Name())
+		_, err := io.Copy(c, c)
+		assert.Nil(t, err)
+		assert.Nil(t, c.Close())
+	})
+	conn, _, done := dialTestSoket(t, s)
+	defer done()
+
+	writeChannelFrame(t, conn, channelOpen, 1, []byte("echo"))
+	kind, id, _ := readChannelFrame(t, conn)
+	assert.Equal(t, channelAccept, kind)
+	assert.Equal(t, uint32(1), id)
+
+	writeChannelFrame(t, conn, channelData, 1, []byte("hello"))
+	kind, _, payload := readChannelFrame(t, conn)
+	assert.Equal(t, channelData, kind)
+	assert.Equal(t, "hello", string(payload))
+
+	writeChannelFrame(t, conn, channelClose, 1, nil)
+	kind, id, _ = readChannelFrame(t, conn)
+	assert.Equal(t, channelClose, kind)
+	assert.Equal(t, uint32(1), id)
+}
+
+func TestChannelRefused(t *testing.T) {
+	s := New(config.WithChannels(64, 16, 8)).(*Soket)
+	defer close(s.done)
+	conn, _, done := dialTestSoket(t, s)
+	defer done()
+
+	writeChannelFrame(t, conn, channelOpen, 1, []byte("unknown"))
+	kind, id, payload := readChannelFrame(t, conn)
+	assert.Equal(t, channelReset, kind)
+	assert.Equal(t, uint32(1), id)
+	assert.Equal(t, ErrChannelRefused.Error(), string(payload))
+}
+
+func TestChannelFlowControl(t *testing.T) {
+	s := New(config.WithChannels(8, 4, 8)).(*Soket)
+	defer close(s.done)
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	opened := make(chan *Channel, 1)
+	go func() {
+		c, err := session.OpenChannel(context.Background(), "telemetry")
+		assert.Nil(t, err)
+		opened <- c
+	}()
+	kind, id, payload := readChannelFrame(t, conn)
+	assert.Equal(t, channelOpen, kind)
+	assert.Equal(t, uint32(2), id)
+	assert.Equal(t, "telemetry", string(payload))
+	writeChannelFrame(t, conn, channelAccept, id, nil)
+	c := <-opened
+
+	written := make(chan int, 1)
+	go func() {
+		n, err := c.Write([]byte("0123456789ab"))
+		assert.Nil(t, err)
+		written <- n
+	}()
+	// the window of 8 bytes is sent in frames of 4, then the writer waits for the client
+	_, _, first := readChannelFrame(t, conn)
+	_, _, second := readChannelFrame(t, conn)
+	assert.Equal(t, "01234567", string(first)+string(second))
+	select {
+	case <-written:
+		t.Fatal("the write did not wait for the window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	writeChannelFrame(t, conn, channelWindow, id, windowFrame(8))
+	_, _, third := readChannelFrame(t, conn)
+	assert.Equal(t, "89ab", string(third))
+	assert.Equal(t, 12, <-written)
+
+	// reading half of the window grants it back to the client
+	writeChannelFrame(t, conn, channelData, id, []byte("abcd"))
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(c, buf)
+	assert.Nil(t, err)
+	kind, _, payload = readChannelFrame(t, conn)
+	assert.Equal(t, channelWindow, kind)
+	assert.Equal(t, windowFrame(4), payload)
+
+	// data beyond the window resets the channel
+	writeChannelFrame(t, conn, channelData, id, []byte("123456789"))
+	kind, _, _ = readChannelFrame(t, conn)
+	assert.Equal(t, channelReset, kind)
+	_, err = c.Read(buf)
+	assert.Equal(t, ErrChannelWindow, err)
+}
+
+func TestChannelsResetWithSession(t *testing.T) {
+	s := New(config.WithChannels(64, 16, 8)).(*Soket)
+	defer close(s.done)
+	reading := make(chan error, 1)
+	s.HandleChannel("chat", func(session *Session, c *Channel) {
+		_, err := c.Read(make([]byte, 1))
+		reading <- err
+	})
+	conn, _, done := dialTestSoket(t, s)
+
+	writeChannelFrame(t, conn, channelOpen, 1, []byte("chat"))
+	readChannelFrame(t, conn)
+	done()
+	select {
+	case err := <-reading:
+		assert.Equal(t, ErrSessionClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the channel was not reset")
+	}
+}
+
+func TestChannelLimit(t *testing.T) {
+	s := New(config.WithChannels(64, 16, 1)).(*Soket)
+	defer close(s.done)
+	s.HandleChannel("chat", func(session *Session, c *Channel) {
+		_, _ = io.Copy(io.Discard, c)
+		assert.Nil(t, c.Close())
+	})
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	writeChannelFrame(t, conn, channelOpen, 1, []byte("chat"))
+	kind, _, _ := readChannelFrame(t, conn)
+	assert.Equal(t, channelAccept, kind)
+
+	writeChannelFrame(t, conn, channelOpen, 3, []byte("chat"))
+	kind, id, payload := readChannelFrame(t, conn)
+	assert.Equal(t, channelReset, kind)
+	assert.Equal(t, uint32(3), id)
+	assert.Equal(t, ErrChannelLimit.Error(), string(payload))
+
+	_, err := session.OpenChannel(context.Background(), "telemetry")
+	assert.Equal(t, ErrChannelLimit, err)
+
+	// a closed channel makes room again
+	writeChannelFrame(t, conn, channelClose, 1, nil)
+	kind, _, _ = readChannelFrame(t, conn)
+	assert.Equal(t, channelClose, kind)
+	assert.Eventually(t, func() bool {
+		session.channelsMutex.Lock()
+		defer session.channelsMutex.Unlock()
+		return len(session.channels) == 0
+	}, time.Second, time.Millisecond)
+	writeChannelFrame(t, conn, channelOpen, 5, []byte("chat"))
+	kind, _, _ = readChannelFrame(t, conn)
+	assert.Equal(t, channelAccept, kind)
+}
+
+func TestChannelFramesAreNotBatched(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.PingPeriod = time.Hour
+	s.Config.BatchMaxMessages = 10
+	s.Config.BatchEnvelope = LengthPrefixedEnvelope
+	s.handlers.sentBinaryMessageHandler = func(*Session, []byte) {}
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &recordingAdapter{}
+	session.socketAdapter = adapter
+
+	assert.Nil(t, session.sendChannelFrame(channelAccept, 1, nil))
+	assert.Nil(t, session.sendChannelFrame(channelData, 1, []byte("data")))
+	close(session.messageQueue)
+	session.writeToSocket()
+
+	assert.Equal(t, []packet{
+		{eType: websocket.BinaryMessage, message: []byte{channelAccept, 0, 0, 0, 1}},
+		{eType: websocket.BinaryMessage, message: []byte{channelData, 0, 0, 0, 1, 'd', 'a', 't', 'a'}},
+	}, adapter.written)
+}
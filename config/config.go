@@ -7,11 +7,81 @@ type Config struct {
 	PongPeriod       time.Duration
 	PingPeriod       time.Duration
 	MaxMessageSize   int
+	ReadBufferSize   int
+	StreamReadLimit  int64
+	StreamWriteLimit int64
 	MessageQueueSize int
+	HighQueueSize    int
+	ControlQueueSize int
+	PriorityWeights  []int
+
+	BatchMaxMessages int
+	BatchMaxBytes    int
+	BatchLinger      time.Duration
+	BatchEnvelope    func(messageType int, messages [][]byte) []byte
+
+	SessionByteBudget int64
+	GlobalByteBudget  int64
+	BudgetPolicy      BudgetPolicy
+
+	HistoryRequestLimit int
+
+	InboxSize int
+	InboxTTL  time.Duration
+
+	ShardCount int
+
+	FanOutWorkers   int
+	FanOutChunkSize int
+
+	NetpollWorkers int
+
+	IdleTimeout     time.Duration
+	TimerResolution time.Duration
+	Clock           Clock
+
+	TransferMaxSize   int64
+	TransferChunkSize int
+	TransferWindow    int
+	TransferTTL       time.Duration
+	MaxUploads        int
+
+	ChannelWindow    int
+	ChannelFrameSize int
+	MaxChannels      int
+
+	CreditMessages int64
+	CreditBytes    int64
+
+	HeartbeatPeriod time.Duration
+	HeartbeatMisses int
+
+	RTTThreshold time.Duration
+}
+
+// Clock tells the time to the timers of the sessions, tests may replace it to control time
+type Clock interface {
+	Now() time.Time
+	// Tick returns a channel ticking every d and a function stopping it
+	Tick(d time.Duration) (<-chan time.Time, func())
 }
 
 type ConfigParam func(*Config)
 
+// BudgetPolicy decides what happens to a message that does not fit in the byte budgets
+type BudgetPolicy int
+
+const (
+	// BudgetDrop drops the message
+	BudgetDrop BudgetPolicy = iota
+
+	// BudgetDropNormal drops only normal priority messages, high and control messages are admitted over the budget
+	BudgetDropNormal
+
+	// BudgetDisconnect drops the message and disconnects the session if it exceeds its own budget
+	BudgetDisconnect
+)
+
 func initConfig() *Config {
 	return &Config{
 		WritePeriod:      10 * time.Second,
@@ -19,6 +89,9 @@ func initConfig() *Config {
 		PongPeriod:       90 * time.Second,
 		MaxMessageSize:   512,
 		MessageQueueSize: 100,
+		HighQueueSize:    20,
+		ControlQueueSize: 5,
+		ShardCount:       16,
 	}
 }
 
@@ -41,6 +114,113 @@ func WithMessageQueueSize(messageQueueSize int) ConfigParam {
 	}
 }
 
+// Messages sent with soket.PriorityHigh and soket.PriorityControl
+// are queued in their own channels, written before the normal ones
+func WithPriorityQueueSizes(controlQueueSize int, highQueueSize int) ConfigParam {
+	return func(c *Config) {
+		if controlQueueSize < 1 || highQueueSize < 1 {
+			panic("priority queue sizes cannot be lower than 1")
+		}
+		c.ControlQueueSize = controlQueueSize
+		c.HighQueueSize = highQueueSize
+	}
+}
+
+// By default a lower priority message is written only if the higher queues are empty
+// with weights, in a round every queue writes at most its weight of messages
+// so the normal queue is not starved by a flood of high priority messages
+func WithPriorityWeights(control int, high int, normal int) ConfigParam {
+	return func(c *Config) {
+		if control < 1 || high < 1 || normal < 1 {
+			panic("priority weights cannot be lower than 1")
+		}
+		c.PriorityWeights = []int{control, high, normal}
+	}
+}
+
+// Queues are limited by bytes as well as by messages
+// sessionByteBudget limits the bytes queued for a session, globalByteBudget for all sessions
+// zero means no limit, policy decides what happens to the messages over the budget
+func WithByteBudgets(sessionByteBudget int64, globalByteBudget int64, policy BudgetPolicy) ConfigParam {
+	return func(c *Config) {
+		c.SessionByteBudget = sessionByteBudget
+		c.GlobalByteBudget = globalByteBudget
+		c.BudgetPolicy = policy
+	}
+}
+
+// Sessions and tags are indexed in shards, each with its own lock
+// so connects, disconnects and broadcasts on different shards do not wait for each other
+func WithShards(shardCount int) ConfigParam {
+	return func(c *Config) {
+		if shardCount < 1 {
+			panic("shardCount cannot be lower than 1")
+		}
+		c.ShardCount = shardCount
+	}
+}
+
+// Broadcasts to more than chunkSize sessions are split into chunks of chunkSize
+// queued by at most workers goroutines in parallel, shared by all broadcasts
+// zero workers queues every broadcast in the goroutine of the caller
+func WithFanOut(workers int, chunkSize int) ConfigParam {
+	return func(c *Config) {
+		if workers > 0 && chunkSize < 1 {
+			panic("chunkSize cannot be lower than 1")
+		}
+		c.FanOutWorkers = workers
+		c.FanOutChunkSize = chunkSize
+	}
+}
+
+// Connections are read by an epoll event loop with readWorkers goroutines instead of a goroutine each
+// and writers are started only while a session has queued messages, linux only
+// zero readWorkers keeps a reading and a writing goroutine for each connection
+func WithNetpoll(readWorkers int) ConfigParam {
+	return func(c *Config) {
+		c.NetpollWorkers = readWorkers
+	}
+}
+
+// Sessions not receiving any message for idleTimeout are closed, zero disables it
+func WithIdleTimeout(idleTimeout time.Duration) ConfigParam {
+	return func(c *Config) {
+		c.IdleTimeout = idleTimeout
+	}
+}
+
+// Pings, pong deadlines and idle timeouts of every session are kept in a timing wheel
+// which ticks every resolution, the timers are due at most one tick late
+func WithTimerResolution(resolution time.Duration) ConfigParam {
+	return func(c *Config) {
+		if resolution <= 0 {
+			panic("resolution must be positive")
+		}
+		c.TimerResolution = resolution
+	}
+}
+
+// The timing wheel tells the time with clock instead of the system clock
+func WithClock(clock Clock) ConfigParam {
+	return func(c *Config) {
+		c.Clock = clock
+	}
+}
+
+// Queued messages of the same type are written together as one message
+// up to maxMessages and maxBytes, waiting at most linger for more to arrive
+// envelope frames the batch, e.g. soket.JSONArrayEnvelope which is used for text messages if it is nil,
+// binary messages are batched only with an envelope and a batch of one message is written as it is
+// maxMessages of zero disables batching
+func WithBatching(maxMessages int, maxBytes int, linger time.Duration, envelope func(messageType int, messages [][]byte) []byte) ConfigParam {
+	return func(c *Config) {
+		c.BatchMaxMessages = maxMessages
+		c.BatchMaxBytes = maxBytes
+		c.BatchLinger = linger
+		c.BatchEnvelope = envelope
+	}
+}
+
 // How long writing to socket should wait?
 // err := s.conn.SetWriteDeadline(time.Now().Add(s.soket.Config.WritePeriod))
 func WithWritePeriod(writePeriod time.Duration) ConfigParam {
@@ -74,3 +254,119 @@ func WithMaxMessageSize(maxMessageSize int) ConfigParam {
 		c.MaxMessageSize = maxMessageSize
 	}
 }
+
+// Received messages are read into pooled buffers of bufferSize bytes instead of a new slice each
+// the message handlers borrow the buffer and must not keep the message after they return
+// larger messages get a buffer of their own which is not pooled
+func WithPooledReads(bufferSize int) ConfigParam {
+	return func(c *Config) {
+		if bufferSize < 1 {
+			panic("bufferSize must be positive")
+		}
+		c.ReadBufferSize = bufferSize
+	}
+}
+
+// Messages read by the stream handler may be up to maxReadSize bytes instead of maxMessageSize
+// and streams sent with Session.SendStream up to maxWriteSize bytes, which are not limited otherwise
+func WithStreaming(maxReadSize int64, maxWriteSize int64) ConfigParam {
+	return func(c *Config) {
+		if maxReadSize < 1 || maxWriteSize < 1 {
+			panic("stream sizes must be positive")
+		}
+		c.StreamReadLimit = maxReadSize
+		c.StreamWriteLimit = maxWriteSize
+	}
+}
+
+// Files are uploaded and downloaded in chunks with the transfer protocol
+// files may be up to maxSize bytes, sent in chunks of at most chunkSize bytes
+// window caps the chunks sent but not acknowledged yet
+// an unfinished upload can be resumed for ttl after its last chunk
+// a user, or a session without user id, has at most maxUploads uploads in progress, begins beyond it are refused
+// the chunks are sent base64 encoded, maxMessageSize must hold them
+func WithTransfers(maxSize int64, chunkSize int, window int, ttl time.Duration, maxUploads int) ConfigParam {
+	return func(c *Config) {
+		if maxSize < 1 || chunkSize < 1 || window < 1 || ttl <= 0 || maxUploads < 1 {
+			panic("transfer limits must be positive")
+		}
+		c.TransferMaxSize = maxSize
+		c.TransferChunkSize = chunkSize
+		c.TransferWindow = window
+		c.TransferTTL = ttl
+		c.MaxUploads = maxUploads
+	}
+}
+
+// Binary messages carry channels multiplexed over the connection, see soket.Session.OpenChannel
+// every binary message is then read as a channel frame and the binary handlers receive none,
+// a binary message longer than maxMessageSize ends the session
+// a channel receives at most window bytes not read yet and sends data frames of at most frameSize bytes
+// a session has at most maxChannels channels open, opens beyond it are refused
+func WithChannels(window int, frameSize int, maxChannels int) ConfigParam {
+	return func(c *Config) {
+		if window < 1 || frameSize < 1 || maxChannels < 1 {
+			panic("window, frameSize and maxChannels must be positive")
+		}
+		c.ChannelWindow = window
+		c.ChannelFrameSize = frameSize
+		c.MaxChannels = maxChannels
+	}
+}
+
+// Clients grant credits for the messages and bytes they can take with {"credits":{"messages":10,"bytes":65536}}
+// and the writer of a session pauses once they are used up, the messages wait in the queue meanwhile
+// messages and bytes are the credits of a new session, a unit of zero is not counted
+func WithCredits(messages int64, bytes int64) ConfigParam {
+	return func(c *Config) {
+		if messages < 0 || bytes < 0 || messages+bytes == 0 {
+			panic("credits cannot be negative and one of them must be positive")
+		}
+		c.CreditMessages = messages
+		c.CreditBytes = bytes
+	}
+}
+
+// Sessions send {"type":"hb"} every period for clients which cannot see pings, e.g. browsers,
+// and clients send it back, a heartbeat or a pong from the client tells it is alive
+// the session is closed once the client let misses periods pass without either
+func WithHeartbeat(period time.Duration, misses int) ConfigParam {
+	return func(c *Config) {
+		if period <= 0 || misses < 1 {
+			panic("period and misses must be positive")
+		}
+		c.HeartbeatPeriod = period
+		c.HeartbeatMisses = misses
+	}
+}
+
+// The latency handler is fired when the average round trip measured from the pongs of a session
+// rises above threshold and when it falls back below it
+func WithRTTThreshold(threshold time.Duration) ConfigParam {
+	return func(c *Config) {
+		if threshold <= 0 {
+			panic("threshold must be positive")
+		}
+		c.RTTThreshold = threshold
+	}
+}
+
+// Clients can page back the history of their tags by sending
+// {"history":{"tag":"room","before":42,"limit":20}}
+// historyRequestLimit caps the messages returned for a request, zero disables the requests
+func WithHistoryRequests(historyRequestLimit int) ConfigParam {
+	return func(c *Config) {
+		c.HistoryRequestLimit = historyRequestLimit
+	}
+}
+
+// Messages sent to a user without connected sessions wait in an inbox
+// and are delivered in order when the user connects again
+// inboxSize is the maximum number of messages kept for a user, zero disables the inbox
+// messages older than inboxTTL are dropped, zero keeps them until delivered
+func WithInbox(inboxSize int, inboxTTL time.Duration) ConfigParam {
+	return func(c *Config) {
+		c.InboxSize = inboxSize
+		c.InboxTTL = inboxTTL
+	}
+}
@@ -0,0 +1,66 @@
+package soket
+
+// ConflationKey marks the message with a subject, e.g. a ticker symbol.
+// If a message with the same key is still waiting in the queue of a session, it is replaced in place
+// instead of queueing another one, so a session never holds more than one pending message per key.
+func ConflationKey(key string) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.conflationKey = key
+	}
+}
+
+// conflate replaces the pending packet with the same key, returns false if there is none.
+// Otherwise it registers a copy of the packet as pending, which must be queued by the caller.
+// The replaced packet takes the TTL and the priority of the new one but keeps its place in its lane.
+func (s *Session) conflate(pck *packet) (*packet, bool) {
+	s.conflationMutex.Lock()
+	defer s.conflationMutex.Unlock()
+	if pending, ok := s.conflated[pck.conflationKey]; ok {
+		s.charge(int64(len(pck.message) - len(pending.message)))
+		pending.eType = pck.eType
+		pending.message = pck.message
+		pending.prepared = pck.prepared
+		pending.expiresAt = pck.expiresAt
+		pending.priority = pck.priority
+		return pending, true
+	}
+	if s.conflated == nil {
+		s.conflated = make(map[string]*packet)
+	}
+	// broadcasts share the packet between sessions, each session replaces its own copy
+	own := *pck
+	s.conflated[pck.conflationKey] = &own
+	return &own, false
+}
+
+// forgetConflated drops a pending packet that could not be queued.
+func (s *Session) forgetConflated(pck *packet) {
+	s.conflationMutex.Lock()
+	defer s.conflationMutex.Unlock()
+	if s.conflated[pck.conflationKey] == pck {
+		delete(s.conflated, pck.conflationKey)
+	}
+}
+
+// latest returns a copy of a queued packet, which conflation may still replace.
+func (s *Session) latest(pck *packet) packet {
+	if pck.conflationKey != "" {
+		s.conflationMutex.Lock()
+		defer s.conflationMutex.Unlock()
+	}
+	return *pck
+}
+
+// takeConflated is called when the packet leaves the queue, it returns the latest content of the packet.
+func (s *Session) takeConflated(pck *packet) *packet {
+	if pck.conflationKey == "" {
+		return pck
+	}
+	s.conflationMutex.Lock()
+	defer s.conflationMutex.Unlock()
+	if s.conflated[pck.conflationKey] == pck {
+		delete(s.conflated, pck.conflationKey)
+	}
+	latest := *pck
+	return &latest
+}
@@ -0,0 +1,67 @@
+package soket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConflation(t *testing.T) {
+	s := newBroadcastTestSoket()
+	first := newBroadcastTestSession(s, "1", 5, "prices")
+	second := newBroadcastTestSession(s, "2", 5, "prices")
+
+	s.BroadcastTextToTag([]byte("AAPL 1"), "prices", ConflationKey("AAPL"))
+	s.BroadcastTextToTag([]byte("MSFT 1"), "prices", ConflationKey("MSFT"))
+	s.BroadcastTextToTag([]byte("news"), "prices")
+	report, err := s.Broadcast([]byte("AAPL 2")).ToTags("prices").With(ConflationKey("AAPL")).Send(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Targeted: 2, Enqueued: 2}, report)
+
+	for _, session := range []*Session{first, second} {
+		assert.Len(t, session.messageQueue, 3)
+		var messages []string
+		for i := 0; i < 3; i++ {
+			messages = append(messages, string(session.takeConflated(<-session.messageQueue).message))
+		}
+		assert.Equal(t, []string{"AAPL 2", "MSFT 1", "news"}, messages)
+	}
+
+	s.BroadcastTextToTag([]byte("AAPL 3"), "prices", ConflationKey("AAPL"))
+	assert.Len(t, first.messageQueue, 1)
+	assert.Equal(t, []byte("AAPL 3"), first.takeConflated(<-first.messageQueue).message)
+}
+
+func TestConflationQueueFull(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 0)
+
+	pck := &packet{eType: websocket.TextMessage, message: []byte("1"), conflationKey: "key"}
+	assert.Equal(t, ErrQueueFull, session.writeMessageToPipe(pck))
+	assert.Empty(t, session.conflated)
+}
+
+func TestConflationTakesTheNewTTL(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 5, "prices")
+
+	s.BroadcastTextToTag([]byte("AAPL 1"), "prices", ConflationKey("AAPL"), ExpireAfter(10*time.Millisecond))
+	s.BroadcastTextToTag([]byte("AAPL 2"), "prices", ConflationKey("AAPL"), ExpireAfter(time.Hour))
+	time.Sleep(15 * time.Millisecond)
+	pck := session.prepare(<-session.messageQueue)
+	if assert.NotNil(t, pck) {
+		assert.Equal(t, "AAPL 2", string(pck.message))
+	}
+
+	// a value without TTL does not inherit the TTL of the one it replaces
+	s.BroadcastTextToTag([]byte("AAPL 3"), "prices", ConflationKey("AAPL"), ExpireAfter(10*time.Millisecond))
+	s.BroadcastTextToTag([]byte("AAPL 4"), "prices", ConflationKey("AAPL"))
+	time.Sleep(15 * time.Millisecond)
+	pck = session.prepare(<-session.messageQueue)
+	if assert.NotNil(t, pck) {
+		assert.Equal(t, "AAPL 4", string(pck.message))
+	}
+}
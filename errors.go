@@ -0,0 +1,104 @@
+package soket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	// ErrQueueFull means the message queue of the session had no room, see config.WithMessageQueueSize.
+	ErrQueueFull = errors.New("message queue is full")
+
+	// ErrSessionClosed means the session was closed before the message was written.
+	ErrSessionClosed = errors.New("session is closed")
+
+	// ErrWriteTimeout means writing to the socket took longer than config.WithWritePeriod.
+	ErrWriteTimeout = errors.New("write deadline exceeded")
+
+	// ErrBudgetExceeded means the message did not fit in the byte budgets, see config.WithByteBudgets.
+	ErrBudgetExceeded = errors.New("byte budget exceeded")
+
+	// ErrPongTimeout means the client did not answer the pings within config.WithPongPeriod, the session is closed.
+	ErrPongTimeout = errors.New("pong not received in time")
+
+	// ErrIdleTimeout means the client sent no message within config.WithIdleTimeout, the session is closed.
+	ErrIdleTimeout = errors.New("session idle for too long")
+
+	// ErrHeartbeatTimeout means the client missed the heartbeats allowed by config.WithHeartbeat, the session is closed.
+	ErrHeartbeatTimeout = errors.New("heartbeats missed")
+
+	// ErrStreamTooLarge means the reader given to SendStream had more data than config.WithStreaming allows.
+	ErrStreamTooLarge = errors.New("stream exceeds the size limit")
+
+	// ErrTransferTooLarge means an upload is larger than config.WithTransfers allows.
+	ErrTransferTooLarge = errors.New("transfer exceeds the size limit")
+
+	// ErrTransferChecksum means the data of an upload does not match the SHA-256 of its end frame.
+	ErrTransferChecksum = errors.New("transfer checksum mismatch")
+
+	// ErrTransferUnknown means a chunk or end frame refers to no upload in progress, e.g. one that expired.
+	ErrTransferUnknown = errors.New("unknown transfer")
+
+	// ErrTransferLimit means the user, or the session without user id, has as many uploads in progress
+	// as config.WithTransfers allows.
+	ErrTransferLimit = errors.New("too many transfers")
+
+	// ErrTransferInUse means another session of the user is uploading with the same transfer id.
+	ErrTransferInUse = errors.New("transfer is in use by another session")
+
+	// ErrTransferFailed means the client refused a file sent with SendFile, the error tells its reason.
+	ErrTransferFailed = errors.New("transfer failed")
+
+	// ErrChannelClosed means the channel was closed, or the channel id is not open.
+	ErrChannelClosed = errors.New("channel is closed")
+
+	// ErrChannelRefused means no handler serves the name of the channel, see HandleChannel.
+	ErrChannelRefused = errors.New("channel refused")
+
+	// ErrChannelLimit means the session has as many channels open as config.WithChannels allows.
+	ErrChannelLimit = errors.New("too many channels")
+
+	// ErrChannelReset means the peer reset the channel.
+	ErrChannelReset = errors.New("channel reset by peer")
+
+	// ErrChannelWindow means the peer sent more data than the window of the channel allowed, the channel is reset.
+	ErrChannelWindow = errors.New("channel window exceeded")
+
+	// ErrInvalidTopic means a tag uses a wildcard other than as a whole level, or TopicWildcardAll before the last level.
+	ErrInvalidTopic = errors.New("invalid topic")
+
+	// ErrMessageExpired means the message waited in the queue longer than its TTL, see ExpireAfter.
+	ErrMessageExpired = errors.New("message expired before it was written")
+)
+
+// Message is a message that was sent or could not be sent.
+type Message struct {
+	Type int
+	Data []byte
+}
+
+// DeliveryError tells which message could not be delivered to which session and why.
+// Use errors.Is with ErrQueueFull, ErrBudgetExceeded, ErrSessionClosed, ErrWriteTimeout or ErrMessageExpired to check the reason.
+type DeliveryError struct {
+	Err     error
+	Session *Session
+	Message Message
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("%v | SessionID: %s MessageType: %d", e.Err, e.Session.GetID(), e.Message.Type)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// writeError turns a timeout into ErrWriteTimeout and keeps the other errors as they are.
+func writeError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrWriteTimeout
+	}
+	return err
+}
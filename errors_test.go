@@ -0,0 +1,56 @@
+package soket
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestWriteError(t *testing.T) {
+	assert.Equal(t, ErrWriteTimeout, writeError(timeoutError{}))
+	assert.Equal(t, websocket.ErrCloseSent, writeError(websocket.ErrCloseSent))
+}
+
+func TestUndelivered(t *testing.T) {
+	s := newBroadcastTestSoket()
+	type undelivered struct {
+		session *Session
+		message Message
+		err     error
+	}
+	var reported []undelivered
+	s.HandleUndelivered(func(session *Session, message Message, err error) {
+		reported = append(reported, undelivered{session, message, err})
+	})
+
+	full := newBroadcastTestSession(s, "full", 0)
+	assert.Equal(t, ErrQueueFull, full.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("1")}))
+	assert.Len(t, reported, 1)
+	assert.True(t, errors.Is(reported[0].err, ErrQueueFull))
+	assert.Equal(t, full, reported[0].session)
+	assert.Equal(t, Message{Type: websocket.TextMessage, Data: []byte("1")}, reported[0].message)
+
+	var deliveryErr *DeliveryError
+	assert.True(t, errors.As(reported[0].err, &deliveryErr))
+	assert.Equal(t, full, deliveryErr.Session)
+
+	session := newBroadcastTestSession(s, "closing", 5)
+	session.socketAdapter = &mockAdapter{}
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("2")}))
+	session.close()
+	assert.Len(t, reported, 2)
+	assert.True(t, errors.Is(reported[1].err, ErrSessionClosed))
+	assert.Equal(t, []byte("2"), reported[1].message.Data)
+
+	assert.Equal(t, ErrSessionClosed, session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("3")}))
+	assert.Len(t, reported, 3)
+	assert.True(t, errors.Is(reported[2].err, ErrSessionClosed))
+}
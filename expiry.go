@@ -0,0 +1,52 @@
+package soket
+
+import (
+	"sync"
+	"time"
+)
+
+// ExpireAfter drops the message instead of writing it if it is still queued after ttl,
+// e.g. "auction ends in 3s" is meaningless a few seconds later.
+// Expired messages are passed to HandleUndelivered with ErrMessageExpired and counted in Metrics.
+func ExpireAfter(ttl time.Duration) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.ttl = ttl
+	}
+}
+
+// expiry keeps the default TTL of the tags.
+type expiry struct {
+	tags  map[string]time.Duration
+	mutex *sync.RWMutex
+}
+
+func newExpiry() *expiry {
+	return &expiry{
+		tags:  make(map[string]time.Duration),
+		mutex: &sync.RWMutex{},
+	}
+}
+
+// shortest returns the shortest default TTL of the tags, zero if none of them has one.
+func (e *expiry) shortest(tags []string) time.Duration {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	var ttl time.Duration
+	for _, tag := range tags {
+		if tagTTL, ok := e.tags[tag]; ok && (ttl == 0 || tagTTL < ttl) {
+			ttl = tagTTL
+		}
+	}
+	return ttl
+}
+
+// SetTagTTL sets the TTL of the messages broadcast to the tag unless they have ExpireAfter, zero removes it.
+func (s *Soket) SetTagTTL(tag string, ttl time.Duration) {
+	s.expiry.mutex.Lock()
+	defer s.expiry.mutex.Unlock()
+	if ttl <= 0 {
+		delete(s.expiry.tags, tag)
+		return
+	}
+	s.expiry.tags[tag] = ttl
+}
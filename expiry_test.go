@@ -0,0 +1,54 @@
+package soket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagTTL(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 5, "auction", "lobby")
+
+	s.SetTagTTL("auction", time.Second)
+	s.SetTagTTL("lobby", time.Minute)
+	assert.Equal(t, time.Second, s.expiry.shortest([]string{"auction", "lobby"}))
+
+	s.BroadcastTextToTag([]byte("default"), "auction")
+	s.BroadcastTextToTag([]byte("own"), "auction", ExpireAfter(time.Hour))
+	s.SetTagTTL("auction", 0)
+	s.BroadcastTextToTag([]byte("none"), "auction")
+
+	now := time.Now()
+	assert.WithinDuration(t, now.Add(time.Second), (<-session.messageQueue).expiresAt, time.Second)
+	assert.WithinDuration(t, now.Add(time.Hour), (<-session.messageQueue).expiresAt, time.Second)
+	assert.True(t, (<-session.messageQueue).expiresAt.IsZero())
+}
+
+func TestWriteToSocketDropsExpired(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.PingPeriod = time.Hour
+	var sent []string
+	s.handlers.sentTextMessageHandler = func(session *Session, message []byte) {
+		sent = append(sent, string(message))
+	}
+	var expired []string
+	s.HandleUndelivered(func(session *Session, message Message, err error) {
+		assert.True(t, errors.Is(err, ErrMessageExpired))
+		expired = append(expired, string(message.Data))
+	})
+	session := newBroadcastTestSession(s, "1", 5)
+	session.socketAdapter = &mockAdapter{}
+
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("stale"), expiresAt: time.Now().Add(-time.Second)})
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("fresh"), expiresAt: time.Now().Add(time.Hour)})
+	close(session.messageQueue)
+	session.writeToSocket()
+
+	assert.Equal(t, []string{"fresh"}, sent)
+	assert.Equal(t, []string{"stale"}, expired)
+	assert.Equal(t, uint64(1), s.Metrics().ExpiredMessages)
+}
@@ -0,0 +1,121 @@
+package soket
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+)
+
+// fanOut bounds the goroutines queueing chunks of large broadcasts, see config.WithFanOut.
+// The slots are shared by every broadcast, so concurrent broadcasts do not multiply the workers.
+type fanOut struct {
+	slots     chan struct{}
+	chunkSize int
+}
+
+func newFanOut(conf *config.Config) *fanOut {
+	if conf.FanOutWorkers <= 0 || conf.FanOutChunkSize <= 0 {
+		return nil
+	}
+	return &fanOut{
+		slots:     make(chan struct{}, conf.FanOutWorkers),
+		chunkSize: conf.FanOutChunkSize,
+	}
+}
+
+// deliver queues the packet to the sessions, splitting them into chunks queued in parallel when fan out is enabled.
+// Sessions not reached before the context is done are left out of the report apart from Targeted.
+func (h *haus) deliver(ctx context.Context, sessions map[*Session]struct{}, pck *packet) (DeliveryReport, error) {
+	report := DeliveryReport{Targeted: len(sessions)}
+	if !h.isOpen() && pck.eType != websocket.CloseMessage {
+		return DeliveryReport{}, nil
+	}
+	pck = pck.shared(len(sessions))
+	if h.fanOut == nil || len(sessions) <= h.fanOut.chunkSize {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		for session := range sessions {
+			report.count(session.writeMessageToPipe(pck))
+		}
+		return report, nil
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	chunk := make([]*Session, 0, h.fanOut.chunkSize)
+	dispatch := func(chunk []*Session) bool {
+		select {
+		case h.fanOut.slots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-h.fanOut.slots }()
+			var partial DeliveryReport
+			for _, session := range chunk {
+				partial.count(session.writeMessageToPipe(pck))
+			}
+			mutex.Lock()
+			report.add(partial)
+			mutex.Unlock()
+		}()
+		return true
+	}
+	for session := range sessions {
+		chunk = append(chunk, session)
+		if len(chunk) < h.fanOut.chunkSize {
+			continue
+		}
+		if !dispatch(chunk) {
+			break
+		}
+		chunk = make([]*Session, 0, h.fanOut.chunkSize)
+	}
+	if ctx.Err() == nil && len(chunk) > 0 && len(chunk) < h.fanOut.chunkSize {
+		dispatch(chunk)
+	}
+	wg.Wait()
+	return report, ctx.Err()
+}
+
+// count adds the outcome of queueing the message to one session.
+func (r *DeliveryReport) count(err error) {
+	switch err {
+	case nil:
+		r.Enqueued++
+	case ErrSessionClosed:
+		r.Closed++
+	default:
+		// ErrQueueFull or ErrBudgetExceeded
+		r.Dropped++
+	}
+}
+
+// BroadcastFuture is the pending result of BroadcastBuilder.SendAsync.
+type BroadcastFuture struct {
+	done   chan struct{}
+	report DeliveryReport
+	err    error
+}
+
+// Done is closed once every chunk of the broadcast is queued.
+func (f *BroadcastFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait returns the report of the broadcast, or the error of ctx if it is done first.
+func (f *BroadcastFuture) Wait(ctx context.Context) (DeliveryReport, error) {
+	select {
+	case <-f.done:
+		return f.report, f.err
+	case <-ctx.Done():
+		return DeliveryReport{}, ctx.Err()
+	}
+}
@@ -0,0 +1,99 @@
+package soket
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFanOutTestSoket(workers int, chunkSize int, sessions int) *Soket {
+	s := newBroadcastTestSoket()
+	s.Config.FanOutWorkers = workers
+	s.Config.FanOutChunkSize = chunkSize
+	s.haus = newHaus(s.Config, s.handlers)
+	for i := 0; i < sessions; i++ {
+		newBroadcastTestSession(s, fmt.Sprint(i), 5)
+	}
+	return s
+}
+
+func TestFanOutDeliversEveryChunk(t *testing.T) {
+	s := newFanOutTestSoket(4, 10, 95)
+	closed := newBroadcastTestSession(s, "closed", 5)
+	closed.closed = true
+
+	report, err := s.Broadcast([]byte("hello")).ToAll().Send(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Targeted: 96, Enqueued: 95, Closed: 1}, report)
+	for session := range s.GetAllSessions() {
+		if session != closed {
+			assert.Len(t, session.messageQueue, 1)
+		}
+	}
+}
+
+func TestFanOutStopsAtDeadline(t *testing.T) {
+	s := newFanOutTestSoket(1, 10, 50)
+	ctx, cancel := context.WithCancel(context.Background())
+	// hold the only worker so no chunk can start
+	s.haus.(*haus).fanOut.slots <- struct{}{}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	report, err := s.haus.deliver(ctx, s.haus.getAllSessions(), &packet{eType: websocket.TextMessage, message: []byte("hello")})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, DeliveryReport{Targeted: 50}, report)
+}
+
+func TestSendAsync(t *testing.T) {
+	s := newFanOutTestSoket(2, 3, 10)
+	future := s.Broadcast([]byte("hello")).ToAll().SendAsync(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, err := future.Wait(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Targeted: 10, Enqueued: 10}, report)
+	<-future.Done()
+}
+
+func TestFanOutDisabled(t *testing.T) {
+	assert.Nil(t, newFanOut(&config.Config{FanOutChunkSize: 10}))
+	assert.Nil(t, newFanOut(&config.Config{FanOutWorkers: 4}))
+}
+
+func benchmarkBroadcast(b *testing.B, workers int) {
+	s := newFanOutTestSoket(workers, 1000, 0)
+	for i := 0; i < 100000; i++ {
+		newBroadcastTestSession(s, fmt.Sprint(i), 1)
+	}
+	sessions := s.GetAllSessions()
+	pck := &packet{eType: websocket.TextMessage, message: []byte("hello")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if report := s.haus.broadcastTo(sessions, pck); report.Enqueued != len(sessions) {
+			b.Fatalf("enqueued %d of %d", report.Enqueued, len(sessions))
+		}
+		// the writers would empty the queues, so every broadcast finds room
+		b.StopTimer()
+		for session := range sessions {
+			session.prepare(<-session.messageQueue)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkBroadcastSerial(b *testing.B) {
+	benchmarkBroadcast(b, 0)
+}
+
+func BenchmarkBroadcastFanOut(b *testing.B) {
+	benchmarkBroadcast(b, 8)
+}
@@ -0,0 +1,155 @@
+package soket
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+)
+
+// flow counts the credits the client granted for messages and bytes, see config.WithCredits.
+// A unit that is not configured is not counted.
+type flow struct {
+	mutex    sync.Mutex
+	messages int64
+	bytes    int64
+	signal   chan struct{}
+
+	countMessages bool
+	countBytes    bool
+}
+
+func newFlow(conf *config.Config) *flow {
+	if conf.CreditMessages <= 0 && conf.CreditBytes <= 0 {
+		return nil
+	}
+	return &flow{
+		messages:      conf.CreditMessages,
+		bytes:         conf.CreditBytes,
+		signal:        make(chan struct{}, 1),
+		countMessages: conf.CreditMessages > 0,
+		countBytes:    conf.CreditBytes > 0,
+	}
+}
+
+// take spends the credits of a message, returns false if there are none left.
+// A message larger than the byte credits left is written while they are positive.
+func (f *flow) take(eType int, size int) bool {
+	if eType != websocket.TextMessage && eType != websocket.BinaryMessage {
+		return true
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.available() {
+		return false
+	}
+	if f.countMessages {
+		f.messages--
+	}
+	if f.countBytes {
+		f.bytes -= int64(size)
+	}
+	return true
+}
+
+func (f *flow) hasCredits() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.available()
+}
+
+func (f *flow) available() bool {
+	return (!f.countMessages || f.messages > 0) && (!f.countBytes || f.bytes > 0)
+}
+
+func (f *flow) grant(messages int64, bytes int64) {
+	f.mutex.Lock()
+	if f.countMessages && messages > 0 {
+		f.messages += messages
+	}
+	if f.countBytes && bytes > 0 {
+		f.bytes += bytes
+	}
+	f.mutex.Unlock()
+	select {
+	case f.signal <- struct{}{}:
+	default:
+	}
+}
+
+type creditsRequest struct {
+	Credits *struct {
+		Messages int64 `json:"messages"`
+		Bytes    int64 `json:"bytes"`
+	} `json:"credits"`
+}
+
+// handleCredits adds the credits granted by a {"credits":{"messages":10,"bytes":65536}} frame,
+// returns false if the message is not one.
+func (s *Session) handleCredits(message []byte) bool {
+	if !bytes.Contains(message, []byte(`"credits"`)) {
+		return false
+	}
+	var request creditsRequest
+	if err := json.Unmarshal(message, &request); err != nil || request.Credits == nil {
+		return false
+	}
+	s.flow.grant(request.Credits.Messages, request.Credits.Bytes)
+	if s.onDemand {
+		s.wake()
+	}
+	return true
+}
+
+// Credits returns the messages and bytes the client allows to be written before the session pauses,
+// see config.WithCredits. Units that are not counted are zero.
+func (s *Session) Credits() (messages int64, bytes int64) {
+	if s.flow == nil {
+		return 0, 0
+	}
+	s.flow.mutex.Lock()
+	defer s.flow.mutex.Unlock()
+	return s.flow.messages, s.flow.bytes
+}
+
+// admitted tells if the packet may be written now, otherwise it is held and the session pauses.
+// An expired packet is admitted without credits, prepare drops it.
+func (s *Session) admitted(pck *packet) bool {
+	if s.flow == nil {
+		return true
+	}
+	if latest := s.latest(pck); latest.priority == PriorityControl || latest.expired(time.Now()) || s.flow.take(latest.eType, len(latest.message)) {
+		atomic.StoreInt32(&s.paused, 0)
+		return true
+	}
+	s.held = pck
+	atomic.StoreInt32(&s.paused, 1)
+	return false
+}
+
+// dequeueControl waits for a control packet, new credits or the tick while the session is paused.
+func (s *Session) dequeueControl(tick <-chan time.Time) (*packet, bool) {
+	select {
+	case pck, ok := <-s.controlQueue:
+		return pck, ok
+	case <-s.flow.signal:
+		return nil, true
+	case <-tick:
+		return nil, true
+	}
+}
+
+// writable tells if an on demand writer has anything to write, a paused session only writes control packets.
+func (s *Session) writable() bool {
+	if len(s.controlQueue) > 0 {
+		return true
+	}
+	if s.flow != nil && !s.flow.hasCredits() {
+		return false
+	}
+	return s.pending() > 0 || atomic.LoadInt32(&s.paused) == 1
+}
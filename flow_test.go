@@ -0,0 +1,161 @@
+package soket
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedAdapter records the written messages for a writer running in its own goroutine.
+type lockedAdapter struct {
+	mockAdapter
+	mutex   sync.Mutex
+	written []string
+}
+
+func (l *lockedAdapter) WriteMessage(messageType int, data []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if messageType == websocket.PingMessage {
+		data = []byte("ping")
+	}
+	l.written = append(l.written, string(data))
+	return nil
+}
+
+func (l *lockedAdapter) messages() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.written...)
+}
+
+func newFlowTestSession(messages int64, bytes int64) (*Session, *lockedAdapter) {
+	s := newBroadcastTestSoket()
+	s.Config.WritePeriod = time.Second
+	s.Config.CreditMessages, s.Config.CreditBytes = messages, bytes
+	s.handlers.sentTextMessageHandler = func(*Session, []byte) {}
+	s.handlers.sentPingMessageHandler = func(*Session, []byte) {}
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &lockedAdapter{}
+	session.socketAdapter = adapter
+	session.flow = newFlow(s.Config)
+	return session, adapter
+}
+
+func queueText(session *Session, messages ...string) {
+	for _, message := range messages {
+		session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte(message)})
+	}
+}
+
+func assertWritten(t *testing.T, adapter *lockedAdapter, expected ...string) {
+	assert.Eventually(t, func() bool { return len(adapter.messages()) == len(expected) }, time.Second, time.Millisecond)
+	// nothing more is written while the session is paused
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, expected, adapter.messages())
+}
+
+func TestCreditsPauseTheWriter(t *testing.T) {
+	session, adapter := newFlowTestSession(2, 0)
+	go session.writeToSocket()
+	defer session.close()
+
+	queueText(session, "1", "2", "3", "4")
+	assertWritten(t, adapter, "1", "2")
+
+	// pings are written while the session is paused
+	session.writeMessageToPipe(&packet{eType: websocket.PingMessage, priority: PriorityControl})
+	assertWritten(t, adapter, "1", "2", "ping")
+
+	assert.True(t, session.handleCredits([]byte(`{"credits":{"messages":1}}`)))
+	assertWritten(t, adapter, "1", "2", "ping", "3")
+	messages, _ := session.Credits()
+	assert.Equal(t, int64(0), messages)
+}
+
+func TestByteCredits(t *testing.T) {
+	session, adapter := newFlowTestSession(0, 5)
+	go session.writeToSocket()
+	defer session.close()
+
+	// a message larger than the credits left is written while they are positive
+	queueText(session, "0123456789", "next")
+	assertWritten(t, adapter, "0123456789")
+	_, bytes := session.Credits()
+	assert.Equal(t, int64(-5), bytes)
+
+	session.handleCredits([]byte(`{"credits":{"bytes":5}}`))
+	assertWritten(t, adapter, "0123456789")
+	session.handleCredits([]byte(`{"credits":{"bytes":1}}`))
+	assertWritten(t, adapter, "0123456789", "next")
+}
+
+func TestPausedSessionConflates(t *testing.T) {
+	session, adapter := newFlowTestSession(1, 0)
+	go session.writeToSocket()
+	defer session.close()
+
+	queueText(session, "first")
+	assertWritten(t, adapter, "first")
+	for _, price := range []string{"1.00", "1.01", "1.02"} {
+		session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte(price), conflationKey: "price"})
+	}
+	session.handleCredits([]byte(`{"credits":{"messages":5}}`))
+	assertWritten(t, adapter, "first", "1.02")
+}
+
+func TestCreditsWakeTheOnDemandWriter(t *testing.T) {
+	session, adapter := newFlowTestSession(1, 0)
+	session.onDemand = true
+	defer session.close()
+
+	queueText(session, "1", "2")
+	assertWritten(t, adapter, "1")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&session.writing) == 0 }, time.Second, time.Millisecond)
+
+	session.handleCredits([]byte(`{"credits":{"messages":1}}`))
+	assertWritten(t, adapter, "1", "2")
+}
+
+func TestCloseDropsThePausedOnDemandPacket(t *testing.T) {
+	session, adapter := newFlowTestSession(1, 0)
+	session.onDemand = true
+	var undelivered []string
+	session.soket.handlers.undeliveredHandler = func(_ *Session, message Message, err error) {
+		assert.ErrorIs(t, err, ErrSessionClosed)
+		undelivered = append(undelivered, string(message.Data))
+	}
+
+	queueText(session, "1", "2")
+	assertWritten(t, adapter, "1")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&session.writing) == 0 }, time.Second, time.Millisecond)
+
+	session.close()
+	assert.Nil(t, session.held)
+	assert.Equal(t, []string{"2"}, undelivered)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&session.soket.grace.counter))
+}
+
+func TestExpiredPacketTakesNoCredits(t *testing.T) {
+	session, adapter := newFlowTestSession(1, 0)
+	go session.writeToSocket()
+	defer session.close()
+
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("stale"), expiresAt: time.Now().Add(-time.Second)})
+	queueText(session, "fresh")
+	assertWritten(t, adapter, "fresh")
+}
+
+func TestWithCredits(t *testing.T) {
+	assert.Panics(t, func() { config.WithCredits(0, 0)(&config.Config{}) })
+	conf := &config.Config{}
+	config.WithCredits(10, 0)(conf)
+	f := newFlow(conf)
+	assert.True(t, f.countMessages)
+	assert.False(t, f.countBytes)
+}
@@ -1,6 +1,7 @@
 package soket
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 
@@ -11,22 +12,33 @@ import (
 type IHaus interface {
 	filterSessions(func(*Session) bool) map[*Session]struct{}
 	filterSessionsByTag(string) map[*Session]struct{}
+	filterSessionsByTags([]string) map[*Session]struct{}
+	filterSessionsByTagExpr(TagExpr) map[*Session]struct{}
+	filterSessionsByTopic(string) map[*Session]struct{}
+	filterSessionsByUser(string) map[*Session]struct{}
 	getAllSessions() map[*Session]struct{}
 
 	registerSession(*Session, map[string]struct{})
 	unregisterSession(*Session)
-	broadcastTo(map[*Session]struct{}, *packet)
+	subscribe(*Session, []string)
+	hasTag(*Session, string) bool
+	unsubscribe(*Session, []string)
+	broadcastTo(map[*Session]struct{}, *packet) DeliveryReport
+	broadcastToAll(*packet) DeliveryReport
+	deliver(context.Context, map[*Session]struct{}, *packet) (DeliveryReport, error)
 
 	isOpen() bool
 	close()
 }
 
 type haus struct {
-	sessions      map[*Session]struct{}
-	sessionsMutex *sync.RWMutex
+	// sessionShards index the sessions by the hash of their IDs and the users by the hash of their IDs
+	sessionShards []*sessionShard
 
-	sessionsWithTags      map[string]map[*Session]struct{}
-	sessionsWithTagsMutex *sync.RWMutex
+	// tagShards index the sessions by the hash of their tags
+	tagShards []*tagShard
+
+	fanOut *fanOut
 
 	handlers *handlers
 
@@ -35,92 +47,289 @@ type haus struct {
 	state int32
 }
 
+type sessionShard struct {
+	sync.RWMutex
+	sessions          map[*Session]struct{}
+	sessionsWithUsers map[string]map[*Session]struct{}
+}
+
+// tagShard keeps the topic trie of its own tags, a topic is matched against every shard.
+type tagShard struct {
+	sync.RWMutex
+	sessionsWithTags map[string]map[*Session]struct{}
+	topics           *topicNode
+}
+
 func newHaus(conf *config.Config, handlers *handlers) IHaus {
-	return &haus{
-		sessions:              make(map[*Session]struct{}),
-		sessionsMutex:         &sync.RWMutex{},
-		sessionsWithTags:      make(map[string]map[*Session]struct{}),
-		sessionsWithTagsMutex: &sync.RWMutex{},
-		handlers:              handlers,
-		conf:                  conf,
-		state:                 OPENED,
+	shardCount := conf.ShardCount
+	if shardCount < 1 {
+		shardCount = 1
 	}
+	h := &haus{
+		sessionShards: make([]*sessionShard, shardCount),
+		tagShards:     make([]*tagShard, shardCount),
+		fanOut:        newFanOut(conf),
+		handlers:      handlers,
+		conf:          conf,
+		state:         OPENED,
+	}
+	for i := 0; i < shardCount; i++ {
+		h.sessionShards[i] = &sessionShard{
+			sessions:          make(map[*Session]struct{}),
+			sessionsWithUsers: make(map[string]map[*Session]struct{}),
+		}
+		h.tagShards[i] = &tagShard{
+			sessionsWithTags: make(map[string]map[*Session]struct{}),
+			topics:           newTopicNode(),
+		}
+	}
+	return h
 }
 
+// shardIndex hashes the key with FNV-1a.
+func shardIndex(key string, shardCount int) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(shardCount))
+}
+
+func (h *haus) sessionShard(session *Session) *sessionShard {
+	return h.sessionShards[shardIndex(session.id, len(h.sessionShards))]
+}
+
+func (h *haus) userShard(userID string) *sessionShard {
+	return h.sessionShards[shardIndex(userID, len(h.sessionShards))]
+}
+
+func (h *haus) tagShard(tag string) *tagShard {
+	return h.tagShards[shardIndex(tag, len(h.tagShards))]
+}
+
+// filterSessionsByTag returns a copy of the sessions having the tag.
 func (h *haus) filterSessionsByTag(tag string) map[*Session]struct{} {
-	h.sessionsWithTagsMutex.RLock()
-	defer h.sessionsWithTagsMutex.RUnlock()
-	return h.sessionsWithTags[tag]
+	shard := h.tagShard(tag)
+	shard.RLock()
+	defer shard.RUnlock()
+	tagged := shard.sessionsWithTags[tag]
+	sessions := make(map[*Session]struct{}, len(tagged))
+	for session := range tagged {
+		sessions[session] = struct{}{}
+	}
+	return sessions
 }
 
-func (h *haus) filterSessions(filter func(*Session) bool) map[*Session]struct{} {
+// filterSessionsByTags returns the union of the sessions having any of the tags.
+func (h *haus) filterSessionsByTags(tags []string) map[*Session]struct{} {
 	sessions := make(map[*Session]struct{})
-	h.sessionsMutex.RLock()
-	for session := range h.sessions {
-		if filter(session) {
+	for _, tag := range tags {
+		shard := h.tagShard(tag)
+		shard.RLock()
+		for session := range shard.sessionsWithTags[tag] {
 			sessions[session] = struct{}{}
 		}
+		shard.RUnlock()
+	}
+	return sessions
+}
+
+// filterSessionsByTopic returns the sessions subscribed to the topic, including wildcard subscriptions.
+func (h *haus) filterSessionsByTopic(topic string) map[*Session]struct{} {
+	sessions := make(map[*Session]struct{})
+	parts := splitTopic(topic)
+	for _, shard := range h.tagShards {
+		shard.RLock()
+		shard.topics.match(parts, sessions)
+		shard.RUnlock()
+	}
+	return sessions
+}
+
+func (h *haus) filterSessionsByTagExpr(expr TagExpr) map[*Session]struct{} {
+	return evalTagExpr(expr, h)
+}
+
+// filterSessionsByUser returns the sessions of the user, see Session.SetUserID.
+func (h *haus) filterSessionsByUser(userID string) map[*Session]struct{} {
+	shard := h.userShard(userID)
+	shard.RLock()
+	defer shard.RUnlock()
+	sessions := make(map[*Session]struct{}, len(shard.sessionsWithUsers[userID]))
+	for session := range shard.sessionsWithUsers[userID] {
+		sessions[session] = struct{}{}
+	}
+	return sessions
+}
+
+// everySession returns a copy of the registered sessions.
+func (h *haus) everySession() map[*Session]struct{} {
+	return h.filterSessions(func(*Session) bool { return true })
+}
+
+// filterSessions locks one shard at a time, so sessions registered meanwhile may or may not be included.
+func (h *haus) filterSessions(filter func(*Session) bool) map[*Session]struct{} {
+	sessions := make(map[*Session]struct{})
+	for _, shard := range h.sessionShards {
+		shard.RLock()
+		for session := range shard.sessions {
+			if filter(session) {
+				sessions[session] = struct{}{}
+			}
+		}
+		shard.RUnlock()
 	}
-	h.sessionsMutex.RUnlock()
 	return sessions
 }
 
 func (h *haus) getAllSessions() map[*Session]struct{} {
-	h.sessionsMutex.RLock()
-	defer h.sessionsMutex.RUnlock()
-	return h.sessions
+	return h.everySession()
+}
+
+// countSessions returns the number of registered sessions.
+func (h *haus) countSessions() int {
+	count := 0
+	for _, shard := range h.sessionShards {
+		shard.RLock()
+		count += len(shard.sessions)
+		shard.RUnlock()
+	}
+	return count
 }
 
 func (h *haus) registerSession(session *Session, tags map[string]struct{}) {
-	h.sessionsWithTagsMutex.Lock()
+	session.tagsMutex.Lock()
 	for tag := range tags {
-		_, ok := h.sessionsWithTags[tag]
-		if !ok {
-			h.sessionsWithTags[tag] = make(map[*Session]struct{})
-		}
-		h.sessionsWithTags[tag][session] = struct{}{}
-		if session.tags == nil {
-			session.tags = make(map[string]struct{})
-		}
-		session.tags[tag] = struct{}{}
+		h.addTag(session, tag)
 	}
-	h.sessionsWithTagsMutex.Unlock()
+	session.tagsMutex.Unlock()
 
-	h.sessionsMutex.Lock()
-	h.sessions[session] = struct{}{}
-	h.sessionsMutex.Unlock()
+	shard := h.sessionShard(session)
+	shard.Lock()
+	shard.sessions[session] = struct{}{}
+	shard.Unlock()
+
+	if session.userID != "" {
+		shard := h.userShard(session.userID)
+		shard.Lock()
+		if _, ok := shard.sessionsWithUsers[session.userID]; !ok {
+			shard.sessionsWithUsers[session.userID] = make(map[*Session]struct{})
+		}
+		shard.sessionsWithUsers[session.userID][session] = struct{}{}
+		shard.Unlock()
+	}
 
 	h.handlers.logHandler(session, "SESSION_REGISTERED")
 }
 
 // you need to write tests for this one
 func (h *haus) unregisterSession(session *Session) {
-	var tags map[string]struct{}
-	h.sessionsMutex.Lock()
-	tags = session.tags
-	delete(h.sessions, session)
-	h.sessionsMutex.Unlock()
+	shard := h.sessionShard(session)
+	shard.Lock()
+	delete(shard.sessions, session)
+	shard.Unlock()
 
-	h.sessionsWithTagsMutex.Lock()
-	for tag := range tags {
-		delete(h.sessionsWithTags[tag], session)
+	if session.userID != "" {
+		shard := h.userShard(session.userID)
+		shard.Lock()
+		delete(shard.sessionsWithUsers[session.userID], session)
+		if len(shard.sessionsWithUsers[session.userID]) == 0 {
+			delete(shard.sessionsWithUsers, session.userID)
+		}
+		shard.Unlock()
+	}
+
+	session.tagsMutex.Lock()
+	for tag := range session.tags {
+		h.removeTag(session, tag)
 	}
-	h.sessionsWithTagsMutex.Unlock()
+	session.tagsMutex.Unlock()
 
 	h.handlers.logHandler(session, "SESSION_UNREGISTERED")
 }
 
-func (h *haus) broadcastTo(sessions map[*Session]struct{}, pck *packet) {
+func (h *haus) subscribe(session *Session, tags []string) {
+	session.tagsMutex.Lock()
+	for _, tag := range tags {
+		h.addTag(session, tag)
+	}
+	session.tagsMutex.Unlock()
+}
+
+func (h *haus) unsubscribe(session *Session, tags []string) {
+	session.tagsMutex.Lock()
+	for _, tag := range tags {
+		h.removeTag(session, tag)
+	}
+	session.tagsMutex.Unlock()
+}
+
+func (h *haus) hasTag(session *Session, tag string) bool {
+	session.tagsMutex.Lock()
+	defer session.tagsMutex.Unlock()
+	_, ok := session.tags[tag]
+	return ok
+}
+
+// addTag indexes the session by the tag, session.tagsMutex must be held.
+func (h *haus) addTag(session *Session, tag string) {
+	shard := h.tagShard(tag)
+	shard.Lock()
+	_, ok := shard.sessionsWithTags[tag]
+	if !ok {
+		shard.sessionsWithTags[tag] = make(map[*Session]struct{})
+	}
+	shard.sessionsWithTags[tag][session] = struct{}{}
+	shard.topics.insert(splitTopic(tag), session)
+	shard.Unlock()
+
+	if session.tags == nil {
+		session.tags = make(map[string]struct{})
+	}
+	session.tags[tag] = struct{}{}
+}
+
+// removeTag drops the session from the tag index, session.tagsMutex must be held.
+func (h *haus) removeTag(session *Session, tag string) {
+	shard := h.tagShard(tag)
+	shard.Lock()
+	delete(shard.sessionsWithTags[tag], session)
+	if len(shard.sessionsWithTags[tag]) == 0 {
+		delete(shard.sessionsWithTags, tag)
+	}
+	shard.topics.remove(splitTopic(tag), session)
+	shard.Unlock()
+
+	delete(session.tags, tag)
+}
+
+// broadcastToAll queues the packet to every registered session, copying one shard at a time
+// so registrations are not blocked while the packet is queued.
+func (h *haus) broadcastToAll(pck *packet) DeliveryReport {
+	var report DeliveryReport
 	if !h.isOpen() && pck.eType != websocket.CloseMessage {
-		return
+		return report
 	}
-	for s := range sessions {
-		if s.closed {
-			h.handlers.logHandler(s, "CANNOT_SEND_TO_CLOSED_SESSION")
-			continue
+	pck = pck.shared(h.countSessions())
+	sessions := make(map[*Session]struct{})
+	for _, shard := range h.sessionShards {
+		shard.RLock()
+		for session := range shard.sessions {
+			sessions[session] = struct{}{}
+		}
+		shard.RUnlock()
+		report.add(h.broadcastTo(sessions, pck))
+		for session := range sessions {
+			delete(sessions, session)
 		}
-		s.writeMessageToPipe(pck)
 	}
+	return report
+}
+
+func (h *haus) broadcastTo(sessions map[*Session]struct{}, pck *packet) DeliveryReport {
+	report, _ := h.deliver(context.Background(), sessions, pck)
+	return report
 }
 
 const (
@@ -1,21 +1,25 @@
 package soket
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
 	"github.com/stretchr/testify/assert"
 )
 
+func newTestHaus(shardCount int) *haus {
+	return newHaus(&config.Config{ShardCount: shardCount}, &handlers{
+		logHandler: func(s *Session, log string) {},
+	}).(*haus)
+}
+
 func TestFilterSessionsByTag(t *testing.T) {
-	h := &haus{
-		sessionsWithTagsMutex: &sync.RWMutex{},
-		sessionsWithTags: map[string]map[*Session]struct{}{
-			"tag-exists": {
-				{}: {},
-			},
-		},
-	}
+	h := newTestHaus(4)
+	h.registerSession(&Session{}, map[string]struct{}{"tag-exists": {}})
 	sessions := h.filterSessionsByTag("tag-exists")
 	assert.Len(t, sessions, 1)
 
@@ -24,17 +28,9 @@ func TestFilterSessionsByTag(t *testing.T) {
 }
 
 func TestFilterSessions(t *testing.T) {
-	h := &haus{
-		sessionsMutex: &sync.RWMutex{},
-		sessions: map[*Session]struct{}{
-			{
-				id: "id1",
-			}: {},
-			{
-				id: "id2",
-			}: {},
-		},
-	}
+	h := newTestHaus(4)
+	h.registerSession(&Session{id: "id1"}, nil)
+	h.registerSession(&Session{id: "id2"}, nil)
 	sessions := h.filterSessions(func(s *Session) bool {
 		return s.GetID() == "id1"
 	})
@@ -42,30 +38,14 @@ func TestFilterSessions(t *testing.T) {
 }
 
 func TestGetAllSessions(t *testing.T) {
-	h := &haus{
-		sessionsMutex: &sync.RWMutex{},
-		sessions: map[*Session]struct{}{
-			{
-				id: "id1",
-			}: {},
-			{
-				id: "id2",
-			}: {},
-		},
-	}
+	h := newTestHaus(4)
+	h.registerSession(&Session{id: "id1"}, nil)
+	h.registerSession(&Session{id: "id2"}, nil)
 	assert.Len(t, h.getAllSessions(), 2)
 }
 
 func TestRegisterUnregisterSession(t *testing.T) {
-	h := &haus{
-		sessionsMutex:         &sync.RWMutex{},
-		sessions:              map[*Session]struct{}{},
-		sessionsWithTagsMutex: &sync.RWMutex{},
-		sessionsWithTags:      map[string]map[*Session]struct{}{},
-		handlers: &handlers{
-			logHandler: func(s *Session, log string) {},
-		},
-	}
+	h := newTestHaus(1)
 
 	session1 := &Session{id: "1"}
 	h.registerSession(session1, map[string]struct{}{"tag1": {}})
@@ -81,3 +61,123 @@ func TestRegisterUnregisterSession(t *testing.T) {
 	sessions = h.filterSessionsByTag("tag1")
 	assert.Len(t, sessions, 0)
 }
+
+func TestShardedHausSpreadsSessions(t *testing.T) {
+	h := newTestHaus(8)
+	for i := 0; i < 100; i++ {
+		h.registerSession(&Session{id: fmt.Sprint(i), userID: fmt.Sprint(i % 10)}, map[string]struct{}{fmt.Sprint("tag", i%20): {}})
+	}
+	assert.Equal(t, 100, h.countSessions())
+	assert.Len(t, h.filterSessionsByUser("3"), 10)
+	assert.Len(t, h.filterSessionsByTags([]string{"tag1", "tag2"}), 10)
+
+	used := 0
+	for _, shard := range h.sessionShards {
+		if len(shard.sessions) > 0 {
+			used++
+		}
+	}
+	assert.Greater(t, used, 1)
+}
+
+func TestConcurrentRegisterAndBroadcast(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.haus = newTestHaus(8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				session := newBroadcastTestSession(s, fmt.Sprint(i, "-", j), 100, "room", fmt.Sprint("room.", i))
+				s.Subscribe(session, "extra")
+				s.haus.unregisterSession(session)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.BroadcastTextToAll([]byte("hello"))
+				s.BroadcastTextToTag([]byte("hello"), "room")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 0, s.haus.(*haus).countSessions())
+	assert.Empty(t, s.haus.filterSessionsByTag("room"))
+}
+
+func TestBroadcastToAllReport(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.haus = newTestHaus(4)
+	for i := 0; i < 10; i++ {
+		newBroadcastTestSession(s, fmt.Sprint(i), 5)
+	}
+	report := s.haus.broadcastToAll(&packet{eType: websocket.TextMessage, message: []byte("hello")})
+	assert.Equal(t, DeliveryReport{Targeted: 10, Enqueued: 10}, report)
+}
+
+func benchmarkRegister(b *testing.B, shardCount int) {
+	h := newTestHaus(shardCount)
+	sessions := make([]*Session, 10000)
+	tags := make([]map[string]struct{}, len(sessions))
+	for i := range sessions {
+		sessions[i] = &Session{id: fmt.Sprint(i)}
+		tags[i] = map[string]struct{}{fmt.Sprint("room-", i%100): {}}
+	}
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(atomic.AddInt64(&next, 1)) % len(sessions)
+			h.registerSession(sessions[i], tags[i])
+			h.unregisterSession(sessions[i])
+		}
+	})
+}
+
+func BenchmarkRegisterOneShard(b *testing.B) {
+	benchmarkRegister(b, 1)
+}
+
+func BenchmarkRegisterSixteenShards(b *testing.B) {
+	benchmarkRegister(b, 16)
+}
+
+func benchmarkRegisterWhileBroadcasting(b *testing.B, shardCount int) {
+	s := newBroadcastTestSoket()
+	s.haus = newTestHaus(shardCount)
+	for i := 0; i < 50000; i++ {
+		session := newBroadcastTestSession(s, fmt.Sprint("idle-", i), 1)
+		session.closed = true
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.BroadcastTextToAll([]byte("hello"))
+			}
+		}
+	}()
+	defer close(done)
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			session := &Session{id: fmt.Sprint(atomic.AddInt64(&next, 1)), soket: s, closed: true}
+			s.haus.registerSession(session, map[string]struct{}{"lobby": {}})
+			s.haus.unregisterSession(session)
+		}
+	})
+}
+
+func BenchmarkRegisterWhileBroadcastingOneShard(b *testing.B) {
+	benchmarkRegisterWhileBroadcasting(b, 1)
+}
+
+func BenchmarkRegisterWhileBroadcastingSixteenShards(b *testing.B) {
+	benchmarkRegisterWhileBroadcasting(b, 16)
+}
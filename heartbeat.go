@@ -0,0 +1,65 @@
+package soket
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// heartbeatMessage is sent to the client every config.WithHeartbeat period and expected back from it.
+var heartbeatMessage = []byte(`{"type":"hb"}`)
+
+type heartbeatFrame struct {
+	Type string `json:"type"`
+}
+
+// handleHeartbeat records a {"type":"hb"} message of the client as liveness, returns false if the message is not one.
+func (s *Session) handleHeartbeat(message []byte) bool {
+	if !bytes.Contains(message, []byte(`"hb"`)) {
+		return false
+	}
+	var frame heartbeatFrame
+	if err := json.Unmarshal(message, &frame); err != nil || frame.Type != "hb" {
+		return false
+	}
+	s.alive()
+	return true
+}
+
+// alive records that the client answered, a pong or a heartbeat both count.
+func (s *Session) alive() {
+	atomic.StoreInt64(&s.lastPong, s.soket.now().UnixNano())
+	atomic.StoreInt32(&s.missedHeartbeats, 0)
+}
+
+// MissedHeartbeats returns the heartbeat periods the client let pass without a heartbeat or a pong,
+// see config.WithHeartbeat.
+func (s *Session) MissedHeartbeats() int {
+	return int(atomic.LoadInt32(&s.missedHeartbeats))
+}
+
+// heartbeat counts the periods since the client was last alive, closes the socket once too many were missed
+// and otherwise queues a heartbeat ahead of the other messages.
+func (s *Session) heartbeat() {
+	conf := s.soket.Config
+	quiet := s.soket.now().Sub(time.Unix(0, atomic.LoadInt64(&s.lastPong)))
+	missed := int32(quiet / conf.HeartbeatPeriod)
+	atomic.StoreInt32(&s.missedHeartbeats, missed)
+	if int(missed) >= conf.HeartbeatMisses {
+		s.timersMutex.Lock()
+		stopped := s.heartbeatTimer == nil
+		s.timersMutex.Unlock()
+		if stopped {
+			return
+		}
+		go s.timeout(ErrHeartbeatTimeout)
+		return
+	}
+	if !s.rearm(&s.heartbeatTimer, conf.HeartbeatPeriod) {
+		return
+	}
+	s.queueTimed(&packet{eType: websocket.TextMessage, message: heartbeatMessage, priority: PriorityControl, heartbeat: true})
+}
@@ -0,0 +1,71 @@
+package soket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeats(t *testing.T) {
+	session, adapter, clock, errs := newTimersTestSession(func(c *config.Config) {
+		c.PingPeriod = 0
+		c.PongPeriod = 0
+		c.HeartbeatPeriod, c.HeartbeatMisses = 10*time.Second, 3
+	})
+	// the heartbeats are not written, they stay queued
+	session.controlQueue = make(chan *packet, 10)
+	session.soket.handlers.receivedTextMessageHandler = func(*Session, []byte) {
+		t.Error("the heartbeat must not reach the text handler")
+	}
+	session.soket.handlers.sentTextMessageHandler = func(*Session, []byte) {
+		t.Error("the heartbeat must not reach the sent handler")
+	}
+
+	advance(session, clock, 10*time.Second)
+	assert.Len(t, session.controlQueue, 1)
+	pck := <-session.controlQueue
+	assert.Equal(t, `{"type":"hb"}`, string(pck.message))
+	assert.False(t, session.batchable(pck))
+	session.sent(pck)
+
+	session.received(websocket.TextMessage, []byte(`{"type":"hb"}`))
+	advance(session, clock, 25*time.Second)
+	assert.Equal(t, 0, adapter.count())
+	assert.Greater(t, session.MissedHeartbeats(), 0)
+
+	// a pong counts as well
+	pong(session)
+	assert.Equal(t, 0, session.MissedHeartbeats())
+	advance(session, clock, 20*time.Second)
+	assert.Equal(t, 0, adapter.count())
+
+	advance(session, clock, 20*time.Second)
+	assert.Eventually(t, func() bool { return adapter.count() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []error{ErrHeartbeatTimeout}, errs())
+	assert.Equal(t, 3, session.MissedHeartbeats())
+}
+
+func TestHeartbeatLookalikeIsSent(t *testing.T) {
+	s := newBroadcastTestSoket()
+	var sent []string
+	s.handlers.sentTextMessageHandler = func(_ *Session, message []byte) {
+		sent = append(sent, string(message))
+	}
+	session := newBroadcastTestSession(s, "1", 5)
+
+	// the application may send the same bytes, only the heartbeats of the session are marked
+	pck := &packet{eType: websocket.TextMessage, message: []byte(`{"type":"hb"}`), priority: PriorityControl}
+	session.sent(pck)
+	assert.Equal(t, []string{`{"type":"hb"}`}, sent)
+}
+
+func TestWithHeartbeat(t *testing.T) {
+	assert.Panics(t, func() { config.WithHeartbeat(time.Second, 0)(&config.Config{}) })
+	conf := &config.Config{}
+	config.WithHeartbeat(15*time.Second, 2)(conf)
+	assert.Equal(t, 15*time.Second, conf.HeartbeatPeriod)
+	assert.Equal(t, 2, conf.HeartbeatMisses)
+}
@@ -0,0 +1,312 @@
+package soket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HistoryMessage is a message recorded for a tag.
+type HistoryMessage struct {
+	// ID is assigned by the store, it increases with every appended message.
+	ID      uint64
+	Type    int
+	Message []byte
+	Time    time.Time
+}
+
+// HistoryRetention limits how much history is kept for a tag, zero values mean no limit.
+type HistoryRetention struct {
+	MaxCount int
+	MaxAge   time.Duration
+}
+
+// HistoryQuery selects the most recent messages of a tag, returned oldest first.
+type HistoryQuery struct {
+	// Since skips messages recorded before it.
+	Since time.Time
+	// BeforeID skips messages with an ID greater than or equal to it, used for paging back. Zero means no bound.
+	BeforeID uint64
+	// Limit is the maximum number of messages returned. Zero means no limit.
+	Limit int
+}
+
+// HistoryStore records the messages broadcast to tags. See NewMemoryHistoryStore,
+// stores/boltstore and stores/sqlitestore for the implementations.
+type HistoryStore interface {
+	// Append records the message, sets its ID and applies the retention of the tag.
+	Append(tag string, message *HistoryMessage, retention HistoryRetention) error
+	// Query returns the messages matching the query, leaving out the ones older than the MaxAge of the tag.
+	Query(tag string, query HistoryQuery) ([]HistoryMessage, error)
+}
+
+// history decides which tags are recorded and where.
+type history struct {
+	store HistoryStore
+	tags  map[string]HistoryRetention
+	mutex *sync.RWMutex
+}
+
+func newHistory() *history {
+	return &history{
+		store: NewMemoryHistoryStore(),
+		tags:  make(map[string]HistoryRetention),
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (h *history) record(tag string, pck *packet) error {
+	h.mutex.RLock()
+	retention, ok := h.tags[tag]
+	store := h.store
+	h.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	err := store.Append(tag, &HistoryMessage{
+		Type:    pck.eType,
+		Message: pck.message,
+		Time:    time.Now(),
+	}, retention)
+	if err != nil {
+		return fmt.Errorf("cannot record history of tag %s: %w", tag, err)
+	}
+	return nil
+}
+
+// recordHistory records the packet if the tag is recorded, a failing store is reported to the error handler
+// without a session.
+func (s *Soket) recordHistory(tag string, pck *packet) {
+	if err := s.history.record(tag, pck); err != nil {
+		s.handlers.errorHandler(nil, err)
+	}
+}
+
+func (h *history) query(tag string, query HistoryQuery) ([]HistoryMessage, error) {
+	h.mutex.RLock()
+	store := h.store
+	h.mutex.RUnlock()
+	return store.Query(tag, query)
+}
+
+// SetHistoryStore replaces the store of the recorded messages, the default keeps them in memory.
+func (s *Soket) SetHistoryStore(store HistoryStore) {
+	s.history.mutex.Lock()
+	defer s.history.mutex.Unlock()
+	s.history.store = store
+}
+
+// RecordHistory records the messages broadcast to the tag from now on.
+// The in memory store keeps DefaultHistoryCount messages if retention has no MaxCount.
+func (s *Soket) RecordHistory(tag string, retention HistoryRetention) {
+	s.history.mutex.Lock()
+	defer s.history.mutex.Unlock()
+	s.history.tags[tag] = retention
+}
+
+// StopHistory stops recording the tag, messages already recorded are kept in the store.
+func (s *Soket) StopHistory(tag string) {
+	s.history.mutex.Lock()
+	defer s.history.mutex.Unlock()
+	delete(s.history.tags, tag)
+}
+
+// History returns at most limit of the latest messages of the tag recorded since the time, oldest first.
+func (s *Soket) History(tag string, since time.Time, limit int) ([]HistoryMessage, error) {
+	return s.history.query(tag, HistoryQuery{Since: since, Limit: limit})
+}
+
+// HistoryBefore returns at most limit messages of the tag older than the message with the ID, oldest first.
+func (s *Soket) HistoryBefore(tag string, beforeID uint64, limit int) ([]HistoryMessage, error) {
+	return s.history.query(tag, HistoryQuery{BeforeID: beforeID, Limit: limit})
+}
+
+// historyRequest is the frame clients send to page back, e.g. {"history":{"tag":"room","before":42,"limit":20}}.
+type historyRequest struct {
+	History *struct {
+		Tag    string `json:"tag"`
+		Before uint64 `json:"before"`
+		Limit  int    `json:"limit"`
+	} `json:"history"`
+}
+
+type historyResponseMessage struct {
+	ID     uint64 `json:"id"`
+	Time   int64  `json:"time"`
+	Text   string `json:"text,omitempty"`
+	Binary []byte `json:"binary,omitempty"`
+}
+
+// handleHistoryRequest answers a history request frame, returns false if the message is not one.
+// Only the tags of the session can be requested.
+func (s *Soket) handleHistoryRequest(session *Session, message []byte) bool {
+	if !bytes.Contains(message, []byte(`"history"`)) {
+		return false
+	}
+	var request historyRequest
+	if err := json.Unmarshal(message, &request); err != nil || request.History == nil {
+		return false
+	}
+	tag := request.History.Tag
+	limit := request.History.Limit
+	if limit <= 0 || limit > s.Config.HistoryRequestLimit {
+		limit = s.Config.HistoryRequestLimit
+	}
+	messages := make([]historyResponseMessage, 0)
+	if s.haus.hasTag(session, tag) {
+		recorded, err := s.history.query(tag, HistoryQuery{BeforeID: request.History.Before, Limit: limit})
+		if err != nil {
+			s.handlers.errorHandler(session, err)
+		}
+		for _, m := range recorded {
+			response := historyResponseMessage{ID: m.ID, Time: m.Time.UnixMilli()}
+			if m.Type == websocket.TextMessage {
+				response.Text = string(m.Message)
+			} else {
+				response.Binary = m.Message
+			}
+			messages = append(messages, response)
+		}
+	} else {
+		s.handlers.errorHandler(session, fmt.Errorf("history requested for a tag the session does not have | Tag: %s", tag))
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"history": map[string]interface{}{
+			"tag":      tag,
+			"messages": messages,
+		},
+	})
+	s.BroadcastTextTo(payload, map[*Session]struct{}{session: {}})
+	return true
+}
+
+// DefaultHistoryCount is the number of messages the in memory store keeps for a tag without MaxCount.
+const DefaultHistoryCount = 100
+
+type historyRing struct {
+	messages []HistoryMessage
+	start    int
+	count    int
+	nextID   uint64
+	maxAge   time.Duration
+}
+
+func (r *historyRing) at(i int) *HistoryMessage {
+	return &r.messages[(r.start+i)%len(r.messages)]
+}
+
+func (r *historyRing) resize(capacity int) {
+	if capacity == len(r.messages) {
+		return
+	}
+	messages := make([]HistoryMessage, capacity)
+	skip := 0
+	if r.count > capacity {
+		skip = r.count - capacity
+	}
+	for i := skip; i < r.count; i++ {
+		messages[i-skip] = *r.at(i)
+	}
+	r.messages = messages
+	r.start = 0
+	r.count -= skip
+}
+
+func (r *historyRing) push(message HistoryMessage) {
+	if r.count == len(r.messages) {
+		r.start = (r.start + 1) % len(r.messages)
+		r.count--
+	}
+	*r.at(r.count) = message
+	r.count++
+}
+
+func (r *historyRing) dropOlderThan(t time.Time) {
+	for r.count > 0 && r.at(0).Time.Before(t) {
+		*r.at(0) = HistoryMessage{}
+		r.start = (r.start + 1) % len(r.messages)
+		r.count--
+	}
+}
+
+// memoryHistoryStore keeps the history of each tag in a ring buffer.
+type memoryHistoryStore struct {
+	rings map[string]*historyRing
+	mutex *sync.Mutex
+}
+
+// NewMemoryHistoryStore creates a HistoryStore that keeps messages in memory, in a ring buffer per tag.
+func NewMemoryHistoryStore() HistoryStore {
+	return &memoryHistoryStore{
+		rings: make(map[string]*historyRing),
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (m *memoryHistoryStore) Append(tag string, message *HistoryMessage, retention HistoryRetention) error {
+	capacity := retention.MaxCount
+	if capacity <= 0 {
+		capacity = DefaultHistoryCount
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ring, ok := m.rings[tag]
+	if !ok {
+		ring = &historyRing{}
+		m.rings[tag] = ring
+	}
+	ring.resize(capacity)
+	ring.maxAge = retention.MaxAge
+	ring.nextID++
+	message.ID = ring.nextID
+	// the caller may reuse the buffer of the message, e.g. a pooled read
+	stored := *message
+	stored.Message = append([]byte(nil), message.Message...)
+	ring.push(stored)
+	if ring.maxAge > 0 {
+		ring.dropOlderThan(message.Time.Add(-ring.maxAge))
+	}
+	return nil
+}
+
+func (m *memoryHistoryStore) Query(tag string, query HistoryQuery) ([]HistoryMessage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ring, ok := m.rings[tag]
+	if !ok {
+		return nil, nil
+	}
+	if ring.maxAge > 0 {
+		ring.dropOlderThan(time.Now().Add(-ring.maxAge))
+	}
+	var messages []HistoryMessage
+	for i := ring.count - 1; i >= 0; i-- {
+		if query.Limit > 0 && len(messages) == query.Limit {
+			break
+		}
+		message := ring.at(i)
+		if query.BeforeID > 0 && message.ID >= query.BeforeID {
+			continue
+		}
+		if message.Time.Before(query.Since) {
+			break
+		}
+		// the ring keeps its buffers, the caller may modify the returned ones
+		copied := *message
+		copied.Message = append([]byte(nil), message.Message...)
+		messages = append(messages, copied)
+	}
+	reverseHistory(messages)
+	return messages, nil
+}
+
+// reverseHistory turns newest first results into oldest first.
+func reverseHistory(messages []HistoryMessage) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
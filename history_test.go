@@ -0,0 +1,140 @@
+package soket
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryHistoryStore(t *testing.T) {
+	store := NewMemoryHistoryStore()
+	now := time.Now()
+	for i, text := range []string{"1", "2", "3", "4"} {
+		message := &HistoryMessage{Message: []byte(text), Time: now.Add(time.Duration(i) * time.Second)}
+		assert.Nil(t, store.Append("room", message, HistoryRetention{MaxCount: 3}))
+		assert.Equal(t, uint64(i+1), message.ID)
+	}
+
+	texts := func(query HistoryQuery) []string {
+		messages, err := store.Query("room", query)
+		assert.Nil(t, err)
+		texts := make([]string, len(messages))
+		for i, message := range messages {
+			texts[i] = string(message.Message)
+		}
+		return texts
+	}
+
+	assert.Equal(t, []string{"2", "3", "4"}, texts(HistoryQuery{}))
+	assert.Equal(t, []string{"3", "4"}, texts(HistoryQuery{Limit: 2}))
+	assert.Equal(t, []string{"2", "3"}, texts(HistoryQuery{BeforeID: 4}))
+	assert.Equal(t, []string{"3", "4"}, texts(HistoryQuery{Since: now.Add(2 * time.Second)}))
+
+	assert.Nil(t, store.Append("room", &HistoryMessage{Message: []byte("5"), Time: now.Add(4 * time.Second)}, HistoryRetention{MaxCount: 2}))
+	assert.Equal(t, []string{"4", "5"}, texts(HistoryQuery{}))
+
+	assert.Nil(t, store.Append("room", &HistoryMessage{Message: []byte("6"), Time: now.Add(time.Hour)}, HistoryRetention{MaxCount: 2, MaxAge: time.Minute}))
+	assert.Equal(t, []string{"6"}, texts(HistoryQuery{}))
+}
+
+func TestMemoryHistoryStoreReturnsCopies(t *testing.T) {
+	store := NewMemoryHistoryStore()
+	assert.Nil(t, store.Append("room", &HistoryMessage{Message: []byte("abc"), Time: time.Now()}, HistoryRetention{}))
+
+	messages, err := store.Query("room", HistoryQuery{})
+	assert.Nil(t, err)
+	messages[0].Message[0] = 'x'
+
+	messages, err = store.Query("room", HistoryQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), messages[0].Message)
+}
+
+func TestRecordHistory(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.RecordHistory("room", HistoryRetention{MaxCount: 10})
+
+	s.BroadcastTextToTag([]byte("recorded"), "room")
+	s.BroadcastTextToTag([]byte("not-recorded"), "other")
+	s.StopHistory("room")
+	s.BroadcastTextToTag([]byte("stopped"), "room")
+
+	messages, err := s.History("room", time.Time{}, 0)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, []byte("recorded"), messages[0].Message)
+
+	messages, err = s.History("other", time.Time{}, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, messages)
+}
+
+type failingHistoryStore struct {
+	HistoryStore
+}
+
+func (failingHistoryStore) Append(string, *HistoryMessage, HistoryRetention) error {
+	return errors.New("disk full")
+}
+
+func TestRecordHistoryKeepsACopy(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.RecordHistory("room", HistoryRetention{MaxCount: 10})
+	buf := []byte("first")
+	s.BroadcastTextToTag(buf, "room")
+	copy(buf, "reuse")
+
+	messages, err := s.History("room", time.Time{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(messages[0].Message))
+}
+
+func TestRecordHistoryError(t *testing.T) {
+	s := newBroadcastTestSoket()
+	var errs []error
+	s.handlers.errorHandler = func(session *Session, err error) {
+		assert.Nil(t, session)
+		errs = append(errs, err)
+	}
+	s.SetHistoryStore(failingHistoryStore{NewMemoryHistoryStore()})
+	s.RecordHistory("room", HistoryRetention{})
+	s.BroadcastTextToTag([]byte("lost"), "room")
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "disk full")
+}
+
+func TestHandleHistoryRequest(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.HistoryRequestLimit = 2
+	s.RecordHistory("room", HistoryRetention{})
+	for _, text := range []string{"1", "2", "3"} {
+		s.BroadcastTextToTag([]byte(text), "room")
+	}
+	member := newBroadcastTestSession(s, "member", 5, "room")
+	outsider := newBroadcastTestSession(s, "outsider", 5)
+
+	assert.False(t, s.handleHistoryRequest(member, []byte("hello")))
+	assert.True(t, s.handleHistoryRequest(member, []byte(`{"history":{"tag":"room","before":3,"limit":10}}`)))
+
+	var response struct {
+		History struct {
+			Tag      string `json:"tag"`
+			Messages []struct {
+				ID   uint64 `json:"id"`
+				Text string `json:"text"`
+			} `json:"messages"`
+		} `json:"history"`
+	}
+	assert.Nil(t, json.Unmarshal((<-member.messageQueue).message, &response))
+	assert.Equal(t, "room", response.History.Tag)
+	assert.Len(t, response.History.Messages, 2)
+	assert.Equal(t, "1", response.History.Messages[0].Text)
+	assert.Equal(t, uint64(2), response.History.Messages[1].ID)
+
+	assert.True(t, s.handleHistoryRequest(outsider, []byte(`{"history":{"tag":"room"}}`)))
+	assert.Nil(t, json.Unmarshal((<-outsider.messageQueue).message, &response))
+	assert.Empty(t, response.History.Messages)
+}
@@ -0,0 +1,302 @@
+package soket
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrInboxFull is passed to the dead letter handler for messages pushed out of a full inbox.
+	ErrInboxFull = errors.New("inbox is full")
+
+	// ErrInboxExpired is passed to the dead letter handler for messages that outlived InboxTTL.
+	ErrInboxExpired = errors.New("inbox message expired")
+)
+
+// InboxMessage is a message kept for a user without connected sessions.
+type InboxMessage struct {
+	Type    int
+	Message []byte
+	Time    time.Time
+}
+
+// InboxStore keeps the messages of disconnected users in order. See NewMemoryInboxStore.
+type InboxStore interface {
+	// Push appends the message, drops and returns the oldest ones if the inbox has more than maxSize.
+	Push(userID string, message InboxMessage, maxSize int) ([]InboxMessage, error)
+	// Drain removes and returns every message of the user, oldest first.
+	Drain(userID string) ([]InboxMessage, error)
+	// Expire removes and returns the messages recorded before the time, by user.
+	Expire(before time.Time) (map[string][]InboxMessage, error)
+}
+
+type inbox struct {
+	store InboxStore
+	mutex *sync.RWMutex
+	// delivery is held from finding no session of a user until the message is kept in the inbox,
+	// and while a connecting session drains it and is registered, so the messages stay in order
+	delivery sync.Mutex
+}
+
+func newInbox() *inbox {
+	return &inbox{
+		store: NewMemoryInboxStore(),
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (i *inbox) get() InboxStore {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.store
+}
+
+// SetInboxStore replaces the store of the offline messages, the default keeps them in memory.
+func (s *Soket) SetInboxStore(store InboxStore) {
+	s.inbox.mutex.Lock()
+	defer s.inbox.mutex.Unlock()
+	s.inbox.store = store
+}
+
+// HandleDeadLetter will be fired for offline messages dropped with ErrInboxFull or ErrInboxExpired.
+func (s *Soket) HandleDeadLetter(f deadLetterFunc) {
+	s.handlers.deadLetterHandler = f
+}
+
+// BroadcastTextToUser broadcasts text to the sessions of the user.
+// If the user has no connected session and the inbox is enabled, the message waits for the next connection.
+func (s *Soket) BroadcastTextToUser(message []byte, userID string) {
+	s.broadcastToUser(userID, &packet{
+		eType:   websocket.TextMessage,
+		message: message,
+	})
+}
+
+// BroadcastBinaryToUser broadcasts binary message to the sessions of the user.
+// If the user has no connected session and the inbox is enabled, the message waits for the next connection.
+func (s *Soket) BroadcastBinaryToUser(message []byte, userID string) {
+	s.broadcastToUser(userID, &packet{
+		eType:   websocket.BinaryMessage,
+		message: message,
+	})
+}
+
+func (s *Soket) broadcastToUser(userID string, pck *packet) {
+	if s.Config.InboxSize <= 0 {
+		s.haus.broadcastTo(s.haus.filterSessionsByUser(userID), pck)
+		return
+	}
+	// sessions already found closed, a session connecting meanwhile is tried before the inbox
+	closed := make(map[*Session]struct{})
+	for {
+		s.inbox.delivery.Lock()
+		sessions := s.haus.filterSessionsByUser(userID)
+		for session := range closed {
+			delete(sessions, session)
+		}
+		if len(sessions) == 0 {
+			s.keepOffline(userID, pck)
+			return
+		}
+		s.inbox.delivery.Unlock()
+		report := s.haus.broadcastTo(sessions, pck)
+		if report.Targeted != report.Closed {
+			return
+		}
+		for session := range sessions {
+			closed[session] = struct{}{}
+		}
+	}
+}
+
+// keepOffline pushes the message to the inbox of the user, it is called with the delivery lock held and releases it.
+func (s *Soket) keepOffline(userID string, pck *packet) {
+	if !s.haus.isOpen() {
+		s.inbox.delivery.Unlock()
+		return
+	}
+	dropped, err := s.inbox.get().Push(userID, InboxMessage{
+		Type:    pck.eType,
+		Message: pck.message,
+		Time:    time.Now(),
+	}, s.Config.InboxSize)
+	s.inbox.delivery.Unlock()
+	if err != nil {
+		s.handlers.errorHandler(nil, fmt.Errorf("cannot keep offline message of user %s: %w", userID, err))
+		return
+	}
+	for _, message := range dropped {
+		s.handlers.deadLetterHandler(userID, message, ErrInboxFull)
+	}
+}
+
+// register makes the session visible to the broadcasts. The offline messages of its user are queued first,
+// under the delivery lock, so a message sent to the user meanwhile is queued after them.
+func (s *Soket) register(session *Session, tags map[string]struct{}) {
+	if s.Config.InboxSize <= 0 || session.userID == "" {
+		s.haus.registerSession(session, tags)
+		return
+	}
+	s.inbox.delivery.Lock()
+	delivery, err := s.deliverInbox(session)
+	s.haus.registerSession(session, tags)
+	s.inbox.delivery.Unlock()
+	// the handlers may broadcast to the user, they run once the lock is released
+	if err != nil {
+		s.handlers.errorHandler(session, err)
+	}
+	for _, message := range delivery.expired {
+		s.handlers.deadLetterHandler(session.userID, message, ErrInboxExpired)
+	}
+	for i, pck := range delivery.refused {
+		session.undelivered(pck, delivery.errs[i])
+	}
+}
+
+// inboxDelivery tells what became of the drained messages that were not queued.
+type inboxDelivery struct {
+	expired []InboxMessage
+	refused []*packet
+	errs    []error
+}
+
+// deliverInbox queues the offline messages of the session's user to the session, it is called with the delivery
+// lock held. If the session closed meanwhile, the messages not queued yet are put back in the inbox for the next
+// connection.
+func (s *Soket) deliverInbox(session *Session) (inboxDelivery, error) {
+	var delivery inboxDelivery
+	store := s.inbox.get()
+	messages, err := store.Drain(session.userID)
+	if err != nil {
+		return delivery, fmt.Errorf("cannot drain offline messages of user %s: %w", session.userID, err)
+	}
+	cutoff := time.Now().Add(-s.Config.InboxTTL)
+	for i, message := range messages {
+		if s.Config.InboxTTL > 0 && message.Time.Before(cutoff) {
+			delivery.expired = append(delivery.expired, message)
+			continue
+		}
+		pck := &packet{eType: message.Type, message: message.Message}
+		err := session.enqueue(pck)
+		if err == ErrSessionClosed {
+			return delivery, s.putBack(session.userID, messages[i:])
+		}
+		if err != nil {
+			delivery.refused = append(delivery.refused, pck)
+			delivery.errs = append(delivery.errs, err)
+			continue
+		}
+		if session.onDemand {
+			session.wake()
+		}
+	}
+	return delivery, nil
+}
+
+// putBack returns drained messages to the emptied inbox in their order, so nothing is pushed out of it.
+func (s *Soket) putBack(userID string, messages []InboxMessage) error {
+	store := s.inbox.get()
+	for _, message := range messages {
+		if _, err := store.Push(userID, message, s.Config.InboxSize); err != nil {
+			return fmt.Errorf("cannot put back offline messages of user %s: %w", userID, err)
+		}
+	}
+	return nil
+}
+
+// expireInbox hands the messages older than InboxTTL to the dead letter handler.
+func (s *Soket) expireInbox() {
+	expired, err := s.inbox.get().Expire(time.Now().Add(-s.Config.InboxTTL))
+	if err != nil {
+		s.handlers.errorHandler(nil, fmt.Errorf("cannot expire offline messages: %w", err))
+		return
+	}
+	for userID, messages := range expired {
+		for _, message := range messages {
+			s.handlers.deadLetterHandler(userID, message, ErrInboxExpired)
+		}
+	}
+}
+
+// this is a goroutine, fired from New if the inbox has a TTL
+func (s *Soket) sweepInbox() {
+	period := s.Config.InboxTTL
+	if period > maxInboxSweepPeriod {
+		period = maxInboxSweepPeriod
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.expireInbox()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// memoryInboxStore keeps the offline messages in memory.
+type memoryInboxStore struct {
+	messages map[string][]InboxMessage
+	mutex    *sync.Mutex
+}
+
+// NewMemoryInboxStore creates an InboxStore that keeps the messages in memory.
+func NewMemoryInboxStore() InboxStore {
+	return &memoryInboxStore{
+		messages: make(map[string][]InboxMessage),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (m *memoryInboxStore) Push(userID string, message InboxMessage, maxSize int) ([]InboxMessage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	messages := append(m.messages[userID], message)
+	var dropped []InboxMessage
+	if len(messages) > maxSize {
+		dropped = append(dropped, messages[:len(messages)-maxSize]...)
+		messages = append([]InboxMessage(nil), messages[len(messages)-maxSize:]...)
+	}
+	m.messages[userID] = messages
+	return dropped, nil
+}
+
+func (m *memoryInboxStore) Drain(userID string) ([]InboxMessage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	messages := m.messages[userID]
+	delete(m.messages, userID)
+	return messages, nil
+}
+
+func (m *memoryInboxStore) Expire(before time.Time) (map[string][]InboxMessage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	expired := make(map[string][]InboxMessage)
+	for userID, messages := range m.messages {
+		i := 0
+		for i < len(messages) && messages[i].Time.Before(before) {
+			i++
+		}
+		if i == 0 {
+			continue
+		}
+		expired[userID] = messages[:i]
+		if i == len(messages) {
+			delete(m.messages, userID)
+		} else {
+			m.messages[userID] = append([]InboxMessage(nil), messages[i:]...)
+		}
+	}
+	return expired, nil
+}
+
+const (
+	maxInboxSweepPeriod = time.Minute
+)
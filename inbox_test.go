@@ -0,0 +1,145 @@
+package soket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryInboxStore(t *testing.T) {
+	store := NewMemoryInboxStore()
+	now := time.Now()
+	for i, text := range []string{"1", "2", "3"} {
+		dropped, err := store.Push("user", InboxMessage{Message: []byte(text), Time: now.Add(time.Duration(i) * time.Second)}, 2)
+		assert.Nil(t, err)
+		if i < 2 {
+			assert.Empty(t, dropped)
+		} else {
+			assert.Equal(t, []byte("1"), dropped[0].Message)
+		}
+	}
+
+	expired, err := store.Expire(now.Add(1500 * time.Millisecond))
+	assert.Nil(t, err)
+	assert.Len(t, expired["user"], 1)
+	assert.Equal(t, []byte("2"), expired["user"][0].Message)
+
+	messages, err := store.Drain("user")
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, []byte("3"), messages[0].Message)
+
+	messages, err = store.Drain("user")
+	assert.Nil(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestBroadcastToUserInbox(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.InboxSize = 2
+	s.Config.InboxTTL = time.Hour
+	var deadLetters []string
+	s.HandleDeadLetter(func(userID string, message InboxMessage, err error) {
+		assert.Equal(t, "user", userID)
+		assert.Equal(t, ErrInboxFull, err)
+		deadLetters = append(deadLetters, string(message.Message))
+	})
+
+	s.BroadcastTextToUser([]byte("1"), "user")
+	s.BroadcastBinaryToUser([]byte("2"), "user")
+	s.BroadcastTextToUser([]byte("3"), "user")
+	assert.Equal(t, []string{"1"}, deadLetters)
+
+	session := &Session{id: "1", userID: "user", soket: s, messageQueue: make(chan *packet, 5)}
+	s.register(session, nil)
+	assert.Equal(t, []byte("2"), (<-session.messageQueue).message)
+	assert.Equal(t, []byte("3"), (<-session.messageQueue).message)
+
+	s.BroadcastTextToUser([]byte("live"), "user")
+	assert.Equal(t, []byte("live"), (<-session.messageQueue).message)
+
+	s.haus.unregisterSession(session)
+	assert.Empty(t, s.haus.filterSessionsByUser("user"))
+}
+
+func TestBroadcastToUserWhileConnecting(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.InboxSize = 5
+	closed := &Session{id: "closed", userID: "user", soket: s, messageQueue: make(chan *packet, 5), closed: true}
+	s.haus.registerSession(closed, nil)
+	connecting := &Session{id: "connecting", userID: "user", soket: s, messageQueue: make(chan *packet, 5)}
+	// the new session connects and drains the inbox while the message is tried on the closed one
+	s.handlers.undeliveredHandler = func(session *Session, message Message, err error) {
+		s.register(connecting, nil)
+	}
+
+	s.BroadcastTextToUser([]byte("late"), "user")
+	assert.Equal(t, []byte("late"), (<-connecting.messageQueue).message)
+	messages, err := s.inbox.get().Drain("user")
+	assert.Nil(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestInboxIsQueuedBeforeLiveMessages(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.InboxSize = 5
+	s.BroadcastTextToUser([]byte("stored"), "user")
+	session := &Session{id: "1", userID: "user", soket: s, messageQueue: make(chan *packet, 5)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.BroadcastTextToUser([]byte("live"), "user")
+	}()
+	s.register(session, nil)
+	<-done
+
+	assert.Equal(t, []byte("stored"), (<-session.messageQueue).message)
+	assert.Equal(t, []byte("live"), (<-session.messageQueue).message)
+}
+
+func TestInboxKeepsMessagesOfClosedSession(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.InboxSize = 5
+	var undelivered []string
+	s.handlers.undeliveredHandler = func(session *Session, message Message, err error) {
+		undelivered = append(undelivered, string(message.Data))
+	}
+
+	s.BroadcastTextToUser([]byte("1"), "user")
+	s.BroadcastTextToUser([]byte("2"), "user")
+	closed := &Session{id: "closed", userID: "user", soket: s, messageQueue: make(chan *packet, 5), closed: true}
+	s.register(closed, nil)
+	s.haus.unregisterSession(closed)
+
+	assert.Empty(t, undelivered)
+	messages, err := s.inbox.get().Drain("user")
+	assert.Nil(t, err)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, []byte("1"), messages[0].Message)
+	assert.Equal(t, []byte("2"), messages[1].Message)
+}
+
+func TestInboxExpiry(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.InboxSize = 5
+	s.Config.InboxTTL = time.Millisecond
+	var expired []string
+	s.HandleDeadLetter(func(userID string, message InboxMessage, err error) {
+		assert.Equal(t, ErrInboxExpired, err)
+		expired = append(expired, string(message.Message))
+	})
+
+	s.BroadcastTextToUser([]byte("swept"), "user")
+	time.Sleep(5 * time.Millisecond)
+	s.expireInbox()
+	assert.Equal(t, []string{"swept"}, expired)
+
+	s.BroadcastTextToUser([]byte("drained"), "user")
+	time.Sleep(5 * time.Millisecond)
+	session := &Session{id: "1", userID: "user", soket: s, messageQueue: make(chan *packet, 5)}
+	s.register(session, nil)
+	assert.Equal(t, []string{"swept", "drained"}, expired)
+	assert.Len(t, session.messageQueue, 0)
+}
@@ -0,0 +1,96 @@
+package soket
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Scores of RTT.Quality, a connection is perfect up to goodRTT and useless from badRTT.
+const (
+	goodRTT = 50 * time.Millisecond
+	badRTT  = time.Second
+)
+
+// RTT is the round trip time of a session measured from the pongs answering its pings.
+// Average and Jitter are smoothed as TCP does, see RFC 6298.
+type RTT struct {
+	// Last is the latest round trip
+	Last time.Duration
+	// Average is the moving average of the round trips, each new one weighs 1/8
+	Average time.Duration
+	// Jitter is the moving average of the deviation of the round trips from Average, each new one weighs 1/4
+	Jitter time.Duration
+	// Samples counts the pongs measured
+	Samples int
+}
+
+// Quality scores the connection from 100, round trips of 50ms or less, down to 0, round trips of a second or more.
+// The deviation counts twice so an unsteady connection scores lower than a steady one of the same average.
+func (r RTT) Quality() int {
+	if r.Samples == 0 {
+		return 100
+	}
+	effective := r.Average + 2*r.Jitter
+	switch {
+	case effective <= goodRTT:
+		return 100
+	case effective >= badRTT:
+		return 0
+	}
+	return int(100 * (badRTT - effective) / (badRTT - goodRTT))
+}
+
+// RTT returns the round trip times measured so far, Samples is zero until the first pong.
+func (s *Session) RTT() RTT {
+	s.rttMutex.Lock()
+	defer s.rttMutex.Unlock()
+	return s.rtt
+}
+
+// stampPing puts the time of writing in the payload of a ping, the client sends it back with its pong.
+func (s *Session) stampPing(pck *packet) {
+	if pck.eType == websocket.PingMessage && pck.message == nil {
+		pck.message = make([]byte, 8)
+		binary.BigEndian.PutUint64(pck.message, uint64(s.soket.now().UnixNano()))
+	}
+}
+
+// measureRTT adds the round trip of a pong carrying the payload of stampPing,
+// the latency handler is fired when the average crosses config.WithRTTThreshold.
+func (s *Session) measureRTT(payload string) {
+	if len(payload) != 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(payload))))
+	rtt := s.soket.now().Sub(sent)
+	if rtt < 0 {
+		return
+	}
+	s.rttMutex.Lock()
+	r := &s.rtt
+	if r.Samples == 0 {
+		r.Average, r.Jitter = rtt, rtt/2
+	} else {
+		deviation := r.Average - rtt
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		r.Jitter += (deviation - r.Jitter) / 4
+		r.Average += (rtt - r.Average) / 8
+	}
+	r.Last = rtt
+	r.Samples++
+	snapshot := *r
+	threshold := s.soket.Config.RTTThreshold
+	crossed := threshold > 0 && (r.Average > threshold) != s.slowRTT
+	if crossed {
+		s.slowRTT = !s.slowRTT
+	}
+	slow := s.slowRTT
+	s.rttMutex.Unlock()
+	if crossed {
+		s.soket.handlers.latencyHandler(s, snapshot, slow)
+	}
+}
@@ -0,0 +1,67 @@
+package soket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// roundTrip writes a ping and answers it with a pong d later.
+func roundTrip(t *testing.T, session *Session, clock *fakeClock, d time.Duration) {
+	pck := &packet{eType: websocket.PingMessage}
+	assert.Nil(t, session.writePacket(pck))
+	assert.Len(t, pck.message, 8)
+	clock.now = clock.now.Add(d)
+	pongWithPayload(session, string(pck.message))
+}
+
+func TestRTT(t *testing.T) {
+	session, _, clock, _ := newTimersTestSession(func(*config.Config) {})
+	assert.Equal(t, 100, session.RTT().Quality())
+
+	// a pong without a timestamp is not measured
+	pong(session)
+	roundTrip(t, session, clock, 100*time.Millisecond)
+	assert.Equal(t, RTT{Last: 100 * time.Millisecond, Average: 100 * time.Millisecond, Jitter: 50 * time.Millisecond, Samples: 1}, session.RTT())
+
+	roundTrip(t, session, clock, 200*time.Millisecond)
+	rtt := session.RTT()
+	assert.Equal(t, 200*time.Millisecond, rtt.Last)
+	assert.Equal(t, 112500*time.Microsecond, rtt.Average)
+	assert.Equal(t, 62500*time.Microsecond, rtt.Jitter)
+	assert.Equal(t, 80, rtt.Quality())
+
+	assert.Equal(t, 0, RTT{Average: time.Second, Samples: 1}.Quality())
+	assert.Equal(t, 100, RTT{Average: 20 * time.Millisecond, Jitter: 10 * time.Millisecond, Samples: 1}.Quality())
+}
+
+func TestRTTThreshold(t *testing.T) {
+	session, _, clock, _ := newTimersTestSession(func(c *config.Config) {
+		c.RTTThreshold = 150 * time.Millisecond
+	})
+	var crossings []bool
+	session.soket.HandleLatency(func(_ *Session, rtt RTT, slow bool) {
+		crossings = append(crossings, slow)
+	})
+
+	for _, d := range []time.Duration{100, 200, 400} {
+		roundTrip(t, session, clock, d*time.Millisecond)
+	}
+	assert.Empty(t, crossings)
+	roundTrip(t, session, clock, 400*time.Millisecond)
+	assert.Equal(t, []bool{true}, crossings)
+	roundTrip(t, session, clock, 400*time.Millisecond)
+	assert.Equal(t, []bool{true}, crossings)
+
+	for session.RTT().Average > 150*time.Millisecond {
+		roundTrip(t, session, clock, 0)
+	}
+	assert.Equal(t, []bool{true, false}, crossings)
+}
+
+func TestWithRTTThreshold(t *testing.T) {
+	assert.Panics(t, func() { config.WithRTTThreshold(0)(&config.Config{}) })
+}
@@ -0,0 +1,28 @@
+package soket
+
+import "sync/atomic"
+
+// Metrics is a snapshot of the counters of a soket.
+type Metrics struct {
+	// ExpiredMessages is the number of messages dropped from the queues because their TTL passed.
+	ExpiredMessages uint64
+	// QueuedBytes is the size of the messages waiting in the queues of every session.
+	QueuedBytes int64
+}
+
+type metrics struct {
+	expiredMessages uint64
+	queuedBytes     int64
+}
+
+func (m *metrics) expired() {
+	atomic.AddUint64(&m.expiredMessages, 1)
+}
+
+// Metrics returns the current counters.
+func (s *Soket) Metrics() Metrics {
+	return Metrics{
+		ExpiredMessages: atomic.LoadUint64(&s.metrics.expiredMessages),
+		QueuedBytes:     atomic.LoadInt64(&s.metrics.queuedBytes),
+	}
+}
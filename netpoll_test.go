@@ -0,0 +1,126 @@
+//go:build linux
+
+package soket
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetpollTransport(t *testing.T) {
+	s := New(config.WithNetpoll(2)).(*Soket)
+	assert.NotNil(t, s.netpoll)
+	received := make(chan string, 1)
+	disconnected := make(chan *Session, 1)
+	s.HandleReceivedTextMessage(func(session *Session, message []byte) {
+		received <- string(message)
+	})
+	s.HandleDisconnect(func(session *Session) {
+		disconnected <- session
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, s.HandleRequest(w, r, func(*Session) {}))
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, notification, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Contains(t, string(notification), "sessionId")
+
+	assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	select {
+	case message := <-received:
+		assert.Equal(t, "hello", message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not received")
+	}
+
+	s.BroadcastTextToAll([]byte("to everyone"))
+	messageType, message, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, "to everyone", string(message))
+	var session *Session
+	for session = range s.GetAllSessions() {
+	}
+	// the writer exits once the queue is drained
+	assert.Eventually(t, func() bool { return session.pending() == 0 }, time.Second, time.Millisecond)
+
+	assert.Nil(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	select {
+	case gone := <-disconnected:
+		assert.Same(t, session, gone)
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not disconnected")
+	}
+	assert.Empty(t, s.GetAllSessions())
+	s.netpoll.Close()
+}
+
+func TestNetpollSendStream(t *testing.T) {
+	s := New(config.WithNetpoll(1)).(*Soket)
+	defer s.netpoll.Close()
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	payload := bytes.Repeat([]byte("fragment"), 20000)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.SendStream(websocket.TextMessage, bytes.NewReader(payload))
+	}()
+	messageType, message, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, payload, message)
+	assert.Nil(t, <-sent)
+}
+
+func TestNetpollPartialFrameDoesNotStall(t *testing.T) {
+	s := New(config.WithNetpoll(1)).(*Soket)
+	defer s.netpoll.Close()
+	received := make(chan string, 2)
+	s.HandleReceivedTextMessage(func(session *Session, message []byte) {
+		received <- string(message)
+	})
+	slow, _, doneSlow := dialTestSoket(t, s)
+	defer doneSlow()
+	fast, _, doneFast := dialTestSoket(t, s)
+	defer doneFast()
+
+	// a masked text frame of 11 bytes, only its first 5 are sent
+	frame := []byte{0x81, 0x80 | 11, 1, 2, 3, 4}
+	for i, b := range []byte("hello slow!") {
+		frame = append(frame, b^frame[2+i%4])
+	}
+	_, err := slow.UnderlyingConn().Write(frame[:11])
+	assert.Nil(t, err)
+	assert.Nil(t, fast.WriteMessage(websocket.TextMessage, []byte("hello fast")))
+	select {
+	case message := <-received:
+		assert.Equal(t, "hello fast", message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the partial frame stalled the worker")
+	}
+
+	_, err = slow.UnderlyingConn().Write(frame[11:])
+	assert.Nil(t, err)
+	select {
+	case message := <-received:
+		assert.Equal(t, "hello slow!", message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rest of the frame was not read")
+	}
+}
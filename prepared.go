@@ -0,0 +1,36 @@
+package soket
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// prepared frames a broadcast payload once for every recipient, see adapters.PreparedWriter.
+// websocket.PreparedMessage caches a frame for each compression setting it is written with.
+type prepared struct {
+	once    sync.Once
+	message *websocket.PreparedMessage
+	err     error
+}
+
+func (p *prepared) get(eType int, message []byte) (*websocket.PreparedMessage, error) {
+	p.once.Do(func() {
+		p.message, p.err = websocket.NewPreparedMessage(eType, message)
+	})
+	return p.message, p.err
+}
+
+// shared returns a copy of the packet which frames its payload once for all sessions.
+// The copy keeps packets held elsewhere, e.g. retained ones, untouched.
+func (pck *packet) shared(sessions int) *packet {
+	if sessions < 2 || pck.prepared != nil || pck.stream != nil {
+		return pck
+	}
+	if pck.eType != websocket.TextMessage && pck.eType != websocket.BinaryMessage {
+		return pck
+	}
+	own := *pck
+	own.prepared = &prepared{}
+	return &own
+}
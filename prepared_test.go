@@ -0,0 +1,57 @@
+package soket
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type preparedAdapter struct {
+	mockAdapter
+	prepared []*websocket.PreparedMessage
+}
+
+func (p *preparedAdapter) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	p.prepared = append(p.prepared, pm)
+	return nil
+}
+
+func TestBroadcastPreparesOnce(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.handlers.sentTextMessageHandler = func(session *Session, message []byte) {}
+	first := newBroadcastTestSession(s, "1", 5)
+	second := newBroadcastTestSession(s, "2", 5)
+	firstAdapter, secondAdapter := &preparedAdapter{}, &preparedAdapter{}
+	first.socketAdapter, second.socketAdapter = firstAdapter, secondAdapter
+
+	s.BroadcastTextTo([]byte("hello"), map[*Session]struct{}{first: {}, second: {}})
+	firstPacket, secondPacket := <-first.messageQueue, <-second.messageQueue
+	assert.NotNil(t, firstPacket.prepared)
+	assert.Same(t, firstPacket.prepared, secondPacket.prepared)
+
+	assert.Nil(t, first.writeMessage(firstPacket))
+	assert.Nil(t, second.writeMessage(secondPacket))
+	assert.Len(t, firstAdapter.prepared, 1)
+	assert.Same(t, firstAdapter.prepared[0], secondAdapter.prepared[0])
+}
+
+func TestBroadcastToOneSessionIsNotPrepared(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 5)
+
+	s.BroadcastTextTo([]byte("hello"), map[*Session]struct{}{session: {}})
+	assert.Nil(t, (<-session.messageQueue).prepared)
+}
+
+func TestPreparedFallsBackToWriteMessage(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.handlers.sentTextMessageHandler = func(session *Session, message []byte) {}
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &recordingAdapter{}
+	session.socketAdapter = adapter
+
+	pck := (&packet{eType: websocket.TextMessage, message: []byte("hello")}).shared(2)
+	assert.Nil(t, session.writeMessage(pck))
+	assert.Equal(t, []packet{{eType: websocket.TextMessage, message: []byte("hello")}}, adapter.written)
+}
@@ -0,0 +1,100 @@
+package soket
+
+import "time"
+
+// Priority selects the outbound lane of a message, higher lanes are written first.
+type Priority int
+
+const (
+	// PriorityNormal is the lane of every message without a priority, sized by config.WithMessageQueueSize.
+	PriorityNormal Priority = iota
+
+	// PriorityHigh is the lane of urgent application messages.
+	PriorityHigh
+
+	// PriorityControl is the lane of close messages.
+	PriorityControl
+)
+
+// WithPriority sends the message in the lane of the priority, see config.WithPriorityQueueSizes.
+func WithPriority(priority Priority) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.priority = priority
+	}
+}
+
+// lanes returns the queues of the session from the highest priority to the lowest.
+func (s *Session) lanes() [laneCount]chan *packet {
+	return [laneCount]chan *packet{s.controlQueue, s.highQueue, s.messageQueue}
+}
+
+func (s *Session) lane(priority Priority) chan *packet {
+	switch priority {
+	case PriorityControl:
+		return s.controlQueue
+	case PriorityHigh:
+		return s.highQueue
+	}
+	return s.messageQueue
+}
+
+// dequeue waits for the next packet to write. A nil packet with ok means the ticker ticked,
+// ok is false once the queues are closed.
+// Lanes are served in strict priority order, or by config.WithPriorityWeights if it is set.
+func (s *Session) dequeue(tick <-chan time.Time) (pck *packet, ok bool) {
+	lanes := s.lanes()
+	weights := s.soket.Config.PriorityWeights
+	if len(weights) == laneCount {
+		if s.credits == nil {
+			s.credits = make([]int, laneCount)
+			copy(s.credits, weights)
+		}
+		for i, lane := range lanes {
+			if s.credits[i] <= 0 {
+				continue
+			}
+			if pck, ok, received := tryReceive(lane); received {
+				s.credits[i]--
+				return pck, ok
+			}
+		}
+		// every lane with packets used its credits, start a new round
+		copy(s.credits, weights)
+	}
+	for i, lane := range lanes {
+		if pck, ok, received := tryReceive(lane); received {
+			s.spendCredit(i)
+			return pck, ok
+		}
+	}
+	select {
+	case pck, ok = <-lanes[0]:
+		s.spendCredit(0)
+	case pck, ok = <-lanes[1]:
+		s.spendCredit(1)
+	case pck, ok = <-lanes[2]:
+		s.spendCredit(2)
+	case <-tick:
+		return nil, true
+	}
+	return pck, ok
+}
+
+func (s *Session) spendCredit(lane int) {
+	if s.credits != nil {
+		s.credits[lane]--
+	}
+}
+
+func tryReceive(lane chan *packet) (pck *packet, ok bool, received bool) {
+	select {
+	case pck, ok = <-lane:
+		return pck, ok, true
+	default:
+		return nil, false, false
+	}
+}
+
+const (
+	laneCount = 3
+)
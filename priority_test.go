@@ -0,0 +1,65 @@
+package soket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func dequeueAll(t *testing.T, session *Session, count int) []string {
+	var messages []string
+	for i := 0; i < count; i++ {
+		pck, ok := session.dequeue(nil)
+		assert.True(t, ok)
+		messages = append(messages, string(pck.message))
+	}
+	return messages
+}
+
+func TestStrictPriority(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 5, "feed")
+
+	s.BroadcastTextToTag([]byte("n1"), "feed")
+	s.BroadcastTextToTag([]byte("h1"), "feed", WithPriority(PriorityHigh))
+	s.BroadcastTextToTag([]byte("n2"), "feed")
+	s.BroadcastExitTo(map[*Session]struct{}{session: {}})
+	s.BroadcastTextToTag([]byte("h2"), "feed", WithPriority(PriorityHigh))
+
+	assert.Equal(t, []string{"", "h1", "h2", "n1", "n2"}, dequeueAll(t, session, 5))
+	assert.Len(t, session.controlQueue, 0)
+}
+
+func TestWeightedPriority(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.PriorityWeights = []int{1, 2, 1}
+	session := newBroadcastTestSession(s, "1", 5, "feed")
+
+	for _, text := range []string{"h1", "h2", "h3", "h4"} {
+		s.BroadcastTextToTag([]byte(text), "feed", WithPriority(PriorityHigh))
+	}
+	for _, text := range []string{"n1", "n2"} {
+		s.BroadcastTextToTag([]byte(text), "feed")
+	}
+
+	assert.Equal(t, []string{"h1", "h2", "n1", "h3", "h4", "n2"}, dequeueAll(t, session, 6))
+}
+
+func TestPriorityQueueFull(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 1)
+
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.TextMessage}))
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.TextMessage, priority: PriorityHigh}))
+	assert.Equal(t, ErrQueueFull, session.writeMessageToPipe(&packet{eType: websocket.TextMessage, priority: PriorityHigh}))
+
+	tick := make(chan time.Time, 1)
+	session.dequeue(tick)
+	session.dequeue(tick)
+	tick <- time.Now()
+	pck, ok := session.dequeue(tick)
+	assert.Nil(t, pck)
+	assert.True(t, ok)
+}
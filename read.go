@@ -0,0 +1,114 @@
+package soket
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/adapters"
+	"github.com/soket/config"
+)
+
+// readPool lends the buffers received messages are read into, see config.WithPooledReads.
+type readPool struct {
+	pool sync.Pool
+	size int
+}
+
+func newReadPool(conf *config.Config) *readPool {
+	if conf.ReadBufferSize <= 0 {
+		return nil
+	}
+	p := &readPool{size: conf.ReadBufferSize}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, 0, p.size)
+		return &buf
+	}
+	return p
+}
+
+func (p *readPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// put returns the buffer unless a large message outgrew it, the pool does not keep the largest messages alive.
+func (p *readPool) put(buf *[]byte, used []byte) {
+	if cap(used) > p.size {
+		return
+	}
+	*buf = used[:0]
+	p.pool.Put(buf)
+}
+
+// readsByReader tells if sessions read their messages through adapters.StreamReader.
+func (s *Soket) readsByReader() bool {
+	return s.reads != nil || s.handlers.receivedStreamHandler != nil
+}
+
+// readStreams reads every message through a reader, which is handed to the stream handler as it is
+// or read into a pooled buffer that is reused once the handlers return.
+func (s *Session) readStreams(socket adapters.StreamReader) {
+	for {
+		t, r, err := socket.NextReader()
+		if err != nil {
+			s.readFailed(err)
+			return
+		}
+		if err := s.receivedStream(t, r); err != nil {
+			s.readFailed(err)
+			return
+		}
+	}
+}
+
+func (s *Session) receivedStream(t int, r io.Reader) error {
+	if stream := s.soket.handlers.receivedStreamHandler; stream != nil {
+		if s.speaksProtocol(t) {
+			// the frames of the protocols fit in a message, only a longer message is surely for the handler
+			limit := int64(s.soket.Config.MaxMessageSize)
+			head, err := io.ReadAll(io.LimitReader(r, limit+1))
+			if err != nil {
+				return err
+			}
+			if int64(len(head)) <= limit {
+				s.received(t, head)
+				return nil
+			}
+			if t == websocket.BinaryMessage {
+				// binary messages are reserved for the channel frames
+				return websocket.ErrReadLimit
+			}
+			r = io.MultiReader(bytes.NewReader(head), r)
+		}
+		s.touch()
+		// the bytes are counted as the handler reads them
+		s.countIn(t, 0)
+		stream(s, t, countingReader{reader: r, counter: &s.stats.in[kind(t)]})
+		return nil
+	}
+	buf := s.soket.reads.get()
+	message, err := readMessage(*buf, r)
+	if err == nil {
+		s.received(t, message)
+	}
+	s.soket.reads.put(buf, message)
+	return err
+}
+
+// readMessage appends the message to buf, growing it only if the message does not fit.
+func readMessage(buf []byte, r io.Reader) ([]byte, error) {
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+}
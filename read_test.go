@@ -0,0 +1,165 @@
+package soket
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type streamAdapter struct {
+	mockAdapter
+}
+
+func (a *streamAdapter) NextReader() (int, io.Reader, error) {
+	t, message, err := a.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return t, bytes.NewReader(message), nil
+}
+
+func newReadTestSession(s *Soket, packets ...packet) *Session {
+	session := newBroadcastTestSession(s, "reader", 5)
+	session.socketAdapter = &streamAdapter{mockAdapter{packets: packets}}
+	return session
+}
+
+func TestPooledReads(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.reads = newReadPool(&config.Config{ReadBufferSize: 8})
+	var received []string
+	s.handlers.receivedTextMessageHandler = func(session *Session, message []byte) {
+		received = append(received, string(message))
+	}
+	s.handlers.receivedBinaryMessageHandler = func(session *Session, message []byte) {
+		received = append(received, "binary:"+string(message))
+	}
+	session := newReadTestSession(s,
+		packet{eType: websocket.TextMessage, message: []byte("first")},
+		packet{eType: websocket.TextMessage, message: []byte("longer than the buffer")},
+		packet{eType: websocket.BinaryMessage, message: []byte("second")},
+		packet{eType: websocket.TextMessage, message: []byte{}},
+	)
+	session.readFromSocket()
+	assert.Equal(t, []string{"first", "longer than the buffer", "binary:second", ""}, received)
+}
+
+func TestReadPoolDropsGrownBuffers(t *testing.T) {
+	p := newReadPool(&config.Config{ReadBufferSize: 4})
+	buf := p.get()
+	message, err := readMessage(*buf, strings.NewReader("too long"))
+	assert.Nil(t, err)
+	assert.Equal(t, "too long", string(message))
+	p.put(buf, message)
+	assert.LessOrEqual(t, cap(*p.get()), 4)
+}
+
+func TestReceivedStream(t *testing.T) {
+	s := newBroadcastTestSoket()
+	var received []string
+	s.handlers.receivedStreamHandler = func(session *Session, messageType int, r io.Reader) {
+		data, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		received = append(received, string(data))
+	}
+	newReadTestSession(s, packet{eType: websocket.BinaryMessage, message: []byte("streamed")}).readFromSocket()
+	assert.Equal(t, []string{"streamed"}, received)
+
+	// sockets without NextReader hand over a reader of the whole message
+	session := newBroadcastTestSession(s, "plain", 5)
+	session.socketAdapter = &mockAdapter{packets: []packet{{eType: websocket.BinaryMessage, message: []byte("buffered")}}}
+	session.readFromSocket()
+	assert.Equal(t, []string{"streamed", "buffered"}, received)
+}
+
+func TestReceivedStreamLeavesProtocolFrames(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.MaxMessageSize = 32
+	var received []string
+	s.handlers.receivedStreamHandler = func(session *Session, messageType int, r io.Reader) {
+		data, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		received = append(received, string(data))
+	}
+	long := strings.Repeat("longer than the message size ", 2)
+	session := newReadTestSession(s,
+		packet{eType: websocket.TextMessage, message: []byte(`{"credits":{"messages":3}}`)},
+		packet{eType: websocket.TextMessage, message: []byte("short")},
+		packet{eType: websocket.TextMessage, message: []byte(long)},
+	)
+	session.flow = newFlow(&config.Config{CreditMessages: 1})
+	session.readFromSocket()
+	assert.Equal(t, []string{"short", long}, received)
+	messages, _ := session.Credits()
+	assert.Equal(t, int64(4), messages)
+
+	// sockets without NextReader are checked the same way
+	session = newBroadcastTestSession(s, "plain", 5)
+	session.socketAdapter = &mockAdapter{packets: []packet{{eType: websocket.TextMessage, message: []byte(`{"credits":{"messages":3}}`)}}}
+	session.flow = newFlow(&config.Config{CreditMessages: 1})
+	session.readFromSocket()
+	assert.Equal(t, []string{"short", long}, received)
+	messages, _ = session.Credits()
+	assert.Equal(t, int64(4), messages)
+}
+
+// benchmarkRead sends b.N messages of 1KB over a websocket and reports the allocations of reading them.
+// With stream the messages are read by the stream handler.
+func benchmarkRead(b *testing.B, stream bool, configs ...config.ConfigParam) {
+	s := New(append(configs, config.WithMaxMessageSize(4096))...).(*Soket)
+	defer s.Shutdown()
+	done := make(chan struct{})
+	count := 0
+	onMessage := func() {
+		count++
+		if count == b.N {
+			close(done)
+		}
+	}
+	s.HandleReceivedTextMessage(func(*Session, []byte) { onMessage() })
+	if stream {
+		s.HandleReceivedStream(func(_ *Session, _ int, r io.Reader) {
+			_, _ = io.Copy(io.Discard, r)
+			onMessage()
+		})
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = s.HandleRequest(w, r, func(*Session) {})
+	}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	message := bytes.Repeat([]byte("x"), 1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+func BenchmarkReadPooled(b *testing.B) {
+	benchmarkRead(b, false, config.WithPooledReads(4096))
+}
+
+func BenchmarkReadStream(b *testing.B) {
+	benchmarkRead(b, true)
+}
@@ -0,0 +1,130 @@
+package soket
+
+import (
+	"sync"
+	"time"
+)
+
+// Retain keeps the message as the last one of the tag, new members receive it right after joining.
+func Retain() BroadcastOption {
+	return RetainLast(1)
+}
+
+// RetainLast keeps the last n messages of the tag, new members receive them in order right after joining.
+func RetainLast(n int) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.retain = n
+	}
+}
+
+// RetainFor expires the retained message after ttl. It has no effect without Retain or RetainLast.
+func RetainFor(ttl time.Duration) BroadcastOption {
+	return func(o *broadcastOptions) {
+		o.retainFor = ttl
+	}
+}
+
+type retainedMessage struct {
+	pck       *packet
+	expiresAt time.Time
+	// ttl of the message, counted again from every delivery to a new member
+	ttl time.Duration
+}
+
+func (m *retainedMessage) expired(now time.Time) bool {
+	return !m.expiresAt.IsZero() && !now.Before(m.expiresAt)
+}
+
+// retainStore keeps the retained messages of each tag, oldest first.
+type retainStore struct {
+	messages map[string][]retainedMessage
+	mutex    *sync.Mutex
+}
+
+func newRetainStore() *retainStore {
+	return &retainStore{
+		messages: make(map[string][]retainedMessage),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (r *retainStore) retain(tag string, pck *packet, options *broadcastOptions) {
+	if options.retain <= 0 {
+		return
+	}
+	// the broadcast packet expires with the TTL counted from the broadcast and may be conflated in a queue
+	stored := *pck
+	stored.expiresAt = time.Time{}
+	message := retainedMessage{pck: &stored, ttl: options.ttl}
+	if options.retainFor > 0 {
+		message.expiresAt = time.Now().Add(options.retainFor)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	messages := append(r.messages[tag], message)
+	if len(messages) > options.retain {
+		messages = append([]retainedMessage(nil), messages[len(messages)-options.retain:]...)
+	}
+	r.messages[tag] = messages
+}
+
+// get returns copies of the live retained packets of the tag, expiring with their TTL from now, and drops the expired ones.
+func (r *retainStore) get(tag string) []*packet {
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var live []retainedMessage
+	for _, message := range r.messages[tag] {
+		if !message.expired(now) {
+			live = append(live, message)
+		}
+	}
+	if len(live) == 0 {
+		delete(r.messages, tag)
+		return nil
+	}
+	r.messages[tag] = live
+	packets := make([]*packet, len(live))
+	for i, message := range live {
+		pck := *message.pck
+		if message.ttl > 0 {
+			pck.expiresAt = now.Add(message.ttl)
+		}
+		packets[i] = &pck
+	}
+	return packets
+}
+
+func (r *retainStore) clear(tag string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.messages, tag)
+}
+
+func (r *retainStore) expire(tag string, after time.Duration) {
+	expiresAt := time.Now().Add(after)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := range r.messages[tag] {
+		r.messages[tag][i].expiresAt = expiresAt
+	}
+}
+
+// deliverRetained queues the retained messages of the tags to the session.
+func (s *Soket) deliverRetained(session *Session, tags []string) {
+	for _, tag := range tags {
+		for _, pck := range s.retained.get(tag) {
+			s.haus.broadcastTo(map[*Session]struct{}{session: {}}, pck)
+		}
+	}
+}
+
+// ClearRetained drops the retained messages of the tag.
+func (s *Soket) ClearRetained(tag string) {
+	s.retained.clear(tag)
+}
+
+// ExpireRetained expires the currently retained messages of the tag after the duration, zero expires them now.
+func (s *Soket) ExpireRetained(tag string, after time.Duration) {
+	s.retained.expire(tag, after)
+}
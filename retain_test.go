@@ -0,0 +1,69 @@
+package soket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetainStore(t *testing.T) {
+	r := newRetainStore()
+	first := &packet{message: []byte("1")}
+	second := &packet{message: []byte("2")}
+	third := &packet{message: []byte("3")}
+
+	r.retain("lobby", first, &broadcastOptions{})
+	assert.Empty(t, r.get("lobby"))
+
+	r.retain("lobby", first, &broadcastOptions{retain: 2})
+	r.retain("lobby", second, &broadcastOptions{retain: 2})
+	r.retain("lobby", third, &broadcastOptions{retain: 2})
+	assert.Equal(t, []*packet{second, third}, r.get("lobby"))
+
+	r.retain("lobby", first, &broadcastOptions{retain: 1})
+	assert.Equal(t, []*packet{first}, r.get("lobby"))
+
+	r.clear("lobby")
+	assert.Empty(t, r.get("lobby"))
+
+	r.retain("lobby", first, &broadcastOptions{retain: 1, retainFor: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+	assert.Empty(t, r.get("lobby"))
+
+	r.retain("lobby", first, &broadcastOptions{retain: 1})
+	r.expire("lobby", 0)
+	assert.Empty(t, r.get("lobby"))
+}
+
+func TestBroadcastToTagRetained(t *testing.T) {
+	s := newBroadcastTestSoket()
+	member := newBroadcastTestSession(s, "member", 5, "lobby")
+
+	s.BroadcastTextToTag([]byte("config-1"), "lobby", RetainLast(2))
+	s.BroadcastBinaryToTag([]byte("config-2"), "lobby", Retain())
+	s.BroadcastTextToTag([]byte("not-retained"), "lobby")
+	assert.Len(t, member.messageQueue, 3)
+
+	joiner := newBroadcastTestSession(s, "joiner", 5)
+	s.Subscribe(joiner, "lobby")
+	assert.Len(t, joiner.messageQueue, 1)
+	pck := <-joiner.messageQueue
+	assert.Equal(t, websocket.BinaryMessage, pck.eType)
+	assert.Equal(t, []byte("config-2"), pck.message)
+
+	// the TTL of a retained message is counted from its delivery to a new member
+	s.BroadcastTextToTag([]byte("short-lived"), "lobby", Retain(), ExpireAfter(20*time.Millisecond))
+	time.Sleep(30 * time.Millisecond)
+	ttlJoiner := newBroadcastTestSession(s, "ttl-joiner", 5)
+	s.Subscribe(ttlJoiner, "lobby")
+	pck = <-ttlJoiner.messageQueue
+	assert.Equal(t, []byte("short-lived"), pck.message)
+	assert.False(t, pck.expired(time.Now()))
+
+	s.ClearRetained("lobby")
+	late := newBroadcastTestSession(s, "late", 5)
+	s.Subscribe(late, "lobby")
+	assert.Len(t, late.messageQueue, 0)
+}
@@ -1,9 +1,13 @@
 package soket
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,32 +20,103 @@ type ISession interface {
 	get() *Session
 	writeToSocket()
 	readFromSocket()
+	serve(adapters.EventSocket) error
 	writeMessage(*packet) error
-	writeMessageToPipe(*packet)
+	writeMessageToPipe(*packet) error
+	enqueue(*packet) error
+	undelivered(*packet, error)
 	increaseCounter()
 	decreaseCounter()
 	getInitialNotification() ([]byte, map[*Session]struct{})
 	close()
 
 	GetID() string
+	SetUserID(string)
+	GetUserID() string
 	Set(key string, value interface{})
 	Get(key string) (value interface{}, exists bool)
 }
 
 type packet struct {
-	message []byte
-	eType   int
+	message       []byte
+	eType         int
+	conflationKey string
+	expiresAt     time.Time
+	priority      Priority
+	prepared      *prepared
+	stream        *stream
+	// heartbeat marks the heartbeats queued by the session, they are neither batched nor reported to the sent handlers
+	heartbeat bool
+	// channel marks the frames of the channels, their header must stay at the start of the message so they are not batched
+	channel bool
+}
+
+func (p *packet) expired(now time.Time) bool {
+	return !p.expiresAt.IsZero() && now.After(p.expiresAt)
+}
+
+func (p *packet) toMessage() Message {
+	return Message{Type: p.eType, Data: p.message}
 }
 
 type Session struct {
+	// queuedBytes and stats are kept first for the alignment of their 64-bit counters
+	queuedBytes   int64
+	stats         sessionStats
 	keyVal        map[string]interface{}
 	request       *http.Request
 	soket         *Soket
 	socketAdapter adapters.Socket
 	messageQueue  chan *packet
+	highQueue     chan *packet
+	controlQueue  chan *packet
+	credits       []int
 	tags          map[string]struct{}
+	tagsMutex     sync.Mutex
 	id            string
+	userID        string
 	closed        bool
+	closeMutex    sync.RWMutex
+
+	conflated       map[string]*packet
+	conflationMutex sync.Mutex
+
+	// held is a packet taken from the queue but not written yet, only used by writeToSocket
+	held *packet
+
+	// onDemand sessions are read by an event loop and have no writer goroutine while their queues are empty
+	onDemand bool
+	writing  int32
+
+	// flow counts the credits granted by the client, paused is set while a packet waits for them
+	flow   *flow
+	paused int32
+
+	// timers of the timing wheel, see startTimers
+	pingTimer    *timer
+	pongTimer    *timer
+	idleTimer    *timer
+	timersMutex  sync.Mutex
+	lastPong     int64
+	lastActivity int64
+
+	// heartbeats sent to clients which cannot see pings, see config.WithHeartbeat
+	heartbeatTimer   *timer
+	missedHeartbeats int32
+
+	// rtt is measured from the pongs, slowRTT is set while its average is above config.WithRTTThreshold
+	rtt      RTT
+	slowRTT  bool
+	rttMutex sync.Mutex
+
+	// downloads are the files sent with SendFile, by transfer id
+	downloads      map[string]*download
+	downloadsMutex sync.Mutex
+
+	// channels multiplexed over the connection by id, see OpenChannel
+	channels      map[uint32]*Channel
+	channelsMutex sync.Mutex
+	lastChannelID uint32
 }
 
 func initSession(webSocket adapters.Socket, r *http.Request, s *Soket) (ISession, error) {
@@ -49,23 +124,77 @@ func initSession(webSocket adapters.Socket, r *http.Request, s *Soket) (ISession
 	if err != nil {
 		return nil, err
 	}
+	_, evented := webSocket.(adapters.EventSocket)
 	return &Session{
 		id:            uid.String(),
 		request:       r,
 		soket:         s,
 		socketAdapter: webSocket,
 		messageQueue:  make(chan *packet, s.Config.MessageQueueSize),
+		highQueue:     make(chan *packet, s.Config.HighQueueSize),
+		controlQueue:  make(chan *packet, s.Config.ControlQueueSize),
+		onDemand:      evented,
+		flow:          newFlow(s.Config),
+		stats:         sessionStats{connectedAt: s.now().UnixNano()},
 	}, nil
 }
 
-func (s *Session) writeMessageToPipe(pck *packet) {
-	s.increaseCounter()
-	select {
-	case s.messageQueue <- pck:
-	default:
-		s.soket.handlers.errorHandler(s, fmt.Errorf("message queue is full | MessageQueueSize: %d", s.soket.Config.MessageQueueSize))
-		s.decreaseCounter()
+// writeMessageToPipe queues the packet, returns ErrQueueFull or ErrSessionClosed if it cannot.
+func (s *Session) writeMessageToPipe(pck *packet) error {
+	err := s.enqueue(pck)
+	if err == ErrSessionClosed {
+		s.soket.handlers.logHandler(s, "CANNOT_SEND_TO_CLOSED_SESSION")
 	}
+	if err != nil {
+		s.undelivered(pck, err)
+		return err
+	}
+	if s.onDemand {
+		s.wake()
+	}
+	return nil
+}
+
+// enqueue holds closeMutex so that the queue is not closed while sending to it.
+func (s *Session) enqueue(pck *packet) error {
+	s.closeMutex.RLock()
+	defer s.closeMutex.RUnlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if pck.conflationKey != "" {
+		var replaced bool
+		if pck, replaced = s.conflate(pck); replaced {
+			return nil
+		}
+	}
+	err := s.admit(pck)
+	if err == nil {
+		s.increaseCounter()
+		s.charge(int64(len(pck.message)))
+		select {
+		case s.lane(pck.priority) <- pck:
+			s.queued()
+			return nil
+		default:
+			s.decreaseCounter()
+			s.charge(-int64(len(pck.message)))
+			err = ErrQueueFull
+		}
+	}
+	if pck.conflationKey != "" {
+		s.forgetConflated(pck)
+	}
+	return err
+}
+
+// undelivered reports a packet that will never be written.
+func (s *Session) undelivered(pck *packet, err error) {
+	atomic.AddUint64(&s.stats.dropped, 1)
+	pck.finish(err)
+	deliveryErr := &DeliveryError{Err: err, Session: s, Message: pck.toMessage()}
+	s.soket.handlers.errorHandler(s, deliveryErr)
+	s.soket.handlers.undeliveredHandler(s, deliveryErr.Message, deliveryErr)
 }
 
 func (s *Session) increaseCounter() {
@@ -83,19 +212,50 @@ func (s *Session) writeMessage(pck *packet) error {
 	if err != nil {
 		return err
 	}
-	err = s.socketAdapter.WriteMessage(pck.eType, pck.message)
+	err = s.writePacket(pck)
 	if err != nil {
 		return err
 	}
+	s.sent(pck)
+	return nil
+}
+
+// writePacket writes the frame prepared for the broadcast if the socket supports it.
+func (s *Session) writePacket(pck *packet) error {
+	if pck.stream != nil {
+		return s.writeStream(pck)
+	}
+	s.stampPing(pck)
+	if writer, ok := s.socketAdapter.(adapters.PreparedWriter); ok && pck.prepared != nil {
+		message, err := pck.prepared.get(pck.eType, pck.message)
+		if err != nil {
+			return err
+		}
+		return writer.WritePreparedMessage(message)
+	}
+	return s.socketAdapter.WriteMessage(pck.eType, pck.message)
+}
+
+// sent fires the handler of the packet type after it is written.
+func (s *Session) sent(pck *packet) {
+	if pck.stream != nil {
+		s.countOut(pck.eType, int(pck.stream.written))
+		pck.finish(nil)
+		return
+	}
+	s.countOut(pck.eType, len(pck.message))
+	if pck.heartbeat {
+		return
+	}
 	switch pck.eType {
 	case websocket.TextMessage:
 		s.soket.handlers.sentTextMessageHandler(s, pck.message)
 	case websocket.BinaryMessage:
 		s.soket.handlers.sentBinaryMessageHandler(s, pck.message)
 	case websocket.PingMessage:
+		atomic.AddUint64(&s.stats.pings, 1)
 		s.soket.handlers.sentPingMessageHandler(s, pck.message)
 	}
-	return nil
 }
 
 func (s *Session) get() *Session {
@@ -112,88 +272,288 @@ func (s *Session) getInitialNotification() ([]byte, map[*Session]struct{}) {
 }
 
 // this is a goroutine, fired from soket.go
+// pings are queued by the timing wheel, see startTimers.
 func (s *Session) writeToSocket() {
-	ticker := time.NewTicker(s.soket.Config.PingPeriod)
-	defer ticker.Stop()
+	defer s.dropHeld()
 	for {
-		select {
-		case pck, ok := <-s.messageQueue:
-			if !ok {
-				return
-			}
-			s.soket.handlers.logHandler(s, fmt.Sprintf("SENDING_MESSAGE >> Message: %s Type: %d", string(pck.message), pck.eType))
-			s.decreaseCounter()
-			if err := s.writeMessage(pck); err != nil {
-				s.soket.handlers.errorHandler(s, err)
-				return
-			}
-		case <-ticker.C:
-			// sometimes this ticks after the socket is closed, which generates "websocket: close sent"
-			// I did not want to use !s.soket.haus.isOpen()
-			if err := s.writeMessage(&packet{eType: websocket.PingMessage}); err != nil && err != websocket.ErrCloseSent {
-				s.soket.handlers.errorHandler(s, err)
+		pck, ok := s.nextPacket(nil)
+		if !ok {
+			return
+		}
+		if pck == nil {
+			continue
+		}
+		if err := s.writePending(pck); err != nil {
+			return
+		}
+	}
+}
+
+// writePending writes a packet taken from the queue, with the ones batched behind it if batching is enabled.
+func (s *Session) writePending(pck *packet) error {
+	if pck = s.prepare(pck); pck == nil {
+		return nil
+	}
+	if s.soket.Config.BatchMaxMessages > 0 && s.batchable(pck) {
+		return s.writeBatch(s.collectBatch(pck))
+	}
+	if err := s.writeMessage(pck); err != nil {
+		s.undelivered(pck, writeError(err))
+		return err
+	}
+	return nil
+}
+
+// wake starts a writer for an on demand session unless one is running.
+func (s *Session) wake() {
+	if atomic.CompareAndSwapInt32(&s.writing, 0, 1) {
+		go s.writeOnDemand()
+	}
+}
+
+// writeOnDemand writes until the queues are empty, then the goroutine exits.
+// After a failed write or once the queues are closed no writer is started anymore.
+func (s *Session) writeOnDemand() {
+	for {
+		pck, ok := s.nextPacket(closedTick)
+		switch {
+		case !ok:
+			s.dropHeld()
+			return
+		case pck != nil:
+			if err := s.writePending(pck); err != nil {
+				s.dropHeld()
+				if err := s.socketAdapter.Close(); err != nil {
+					s.soket.handlers.errorHandler(s, err)
+				}
 				return
 			}
+			continue
 		}
+		atomic.StoreInt32(&s.writing, 0)
+		// a packet queued after the queues looked empty may have found the writer still running
+		if !s.writable() || !atomic.CompareAndSwapInt32(&s.writing, 0, 1) {
+			return
+		}
+	}
+}
+
+func (s *Session) pending() int {
+	return len(s.controlQueue) + len(s.highQueue) + len(s.messageQueue)
+}
+
+// prepare is called for every packet leaving the queue, it returns nil if the packet expired.
+func (s *Session) prepare(pck *packet) *packet {
+	pck = s.takeConflated(pck)
+	s.charge(-int64(len(pck.message)))
+	s.soket.handlers.logHandler(s, fmt.Sprintf("SENDING_MESSAGE >> Message: %s Type: %d", string(pck.message), pck.eType))
+	s.decreaseCounter()
+	if pck.expired(time.Now()) {
+		s.soket.metrics.expired()
+		s.undelivered(pck, ErrMessageExpired)
+		return nil
 	}
+	return pck
 }
 
 func (s *Session) readFromSocket() {
-	s.socketAdapter.SetReadLimit(int64(s.soket.Config.MaxMessageSize))
-	if err := s.socketAdapter.SetReadDeadline(time.Now().Add(s.soket.Config.PongPeriod)); err != nil {
+	if err := s.prepareRead(); err != nil {
 		s.soket.handlers.errorHandler(s, err)
 		return
 	}
+	if socket, ok := s.socketAdapter.(adapters.StreamReader); ok && s.soket.readsByReader() {
+		s.readStreams(socket)
+		return
+	}
+	for {
+		t, message, err := s.socketAdapter.ReadMessage()
+		if err != nil {
+			s.readFailed(err)
+			break
+		}
+		s.received(t, message)
+	}
+}
+
+// serve hands the reading to the event loop of the socket, the session is closed when the connection ends.
+func (s *Session) serve(socket adapters.EventSocket) error {
+	if err := s.prepareRead(); err != nil {
+		s.soket.handlers.errorHandler(s, err)
+		s.soket.disconnect(s)
+		return nil
+	}
+	err := socket.Serve(s.received, func(err error) {
+		s.readFailed(err)
+		s.soket.disconnect(s)
+	})
+	if err != nil {
+		s.soket.disconnect(s)
+	}
+	return err
+}
+
+func (s *Session) prepareRead() error {
+	limit := int64(s.soket.Config.MaxMessageSize)
+	if s.soket.handlers.receivedStreamHandler != nil && s.soket.Config.StreamReadLimit > 0 {
+		limit = s.soket.Config.StreamReadLimit
+	}
+	s.socketAdapter.SetReadLimit(limit)
 	s.socketAdapter.SetPingHandler(func(appName string) error {
+		s.countIn(websocket.PingMessage, len(appName))
 		s.soket.handlers.pingHandler(s, appName)
 		return nil
 	})
 	s.socketAdapter.SetPongHandler(func(appName string) error {
-		if err := s.socketAdapter.SetReadDeadline(time.Now().Add(s.soket.Config.PongPeriod)); err != nil {
-			s.soket.handlers.errorHandler(s, err)
-			return err
-		}
+		s.countIn(websocket.PongMessage, len(appName))
+		atomic.AddUint64(&s.stats.pongs, 1)
+		s.alive()
+		s.measureRTT(appName)
 		s.soket.handlers.pongHandler(s, appName)
 		return nil
 	})
 	s.socketAdapter.SetCloseHandler(func(code int, text string) error {
+		s.countIn(websocket.CloseMessage, len(text))
 		s.soket.handlers.closeHandler(code, text)
 		return nil
 	})
-	for {
-		t, message, err := s.socketAdapter.ReadMessage()
-		if err != nil {
-			if c, k := err.(*websocket.CloseError); k {
-				if c.Code == websocket.CloseGoingAway ||
-					c.Code == websocket.CloseAbnormalClosure ||
-					c.Code == websocket.CloseNoStatusReceived {
-					break
-				}
-			}
-			s.soket.handlers.errorHandler(s, err)
-			break
+	return nil
+}
+
+// readFailed reports the error that ended the reading unless the client went away
+// or the session closed the socket itself, e.g. after a pong deadline.
+func (s *Session) readFailed(err error) {
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
+	if c, k := err.(*websocket.CloseError); k {
+		if c.Code == websocket.CloseGoingAway ||
+			c.Code == websocket.CloseAbnormalClosure ||
+			c.Code == websocket.CloseNoStatusReceived {
+			return
+		}
+	}
+	s.soket.handlers.errorHandler(s, err)
+}
+
+func (s *Session) received(t int, message []byte) {
+	s.touch()
+	s.countIn(t, len(message))
+	if s.handleProtocol(t, message) {
+		return
+	}
+	if stream := s.soket.handlers.receivedStreamHandler; stream != nil {
+		stream(s, t, bytes.NewReader(message))
+		return
+	}
+	switch t {
+	case websocket.TextMessage:
+		s.soket.handlers.receivedTextMessageHandler(s, message)
+	case websocket.BinaryMessage:
+		s.soket.handlers.receivedBinaryMessageHandler(s, message)
+	}
+}
+
+// speaksProtocol tells if messages of the type may be frames of the protocols enabled by the config,
+// binary messages all belong to the channels once they are enabled.
+func (s *Session) speaksProtocol(t int) bool {
+	conf := s.soket.Config
+	switch t {
+	case websocket.TextMessage:
+		return conf.HeartbeatPeriod > 0 || conf.HistoryRequestLimit > 0 || s.flow != nil || conf.TransferChunkSize > 0
+	case websocket.BinaryMessage:
+		return conf.ChannelWindow > 0
+	}
+	return false
+}
+
+// handleProtocol handles heartbeats, history requests, credits, transfer and channel frames,
+// returns false if the message is for the application.
+func (s *Session) handleProtocol(t int, message []byte) bool {
+	switch t {
+	case websocket.TextMessage:
+		if s.soket.Config.HeartbeatPeriod > 0 && s.handleHeartbeat(message) {
+			return true
+		}
+		if s.soket.Config.HistoryRequestLimit > 0 && s.soket.handleHistoryRequest(s, message) {
+			return true
+		}
+		if s.flow != nil && s.handleCredits(message) {
+			return true
 		}
-		switch t {
-		case websocket.TextMessage:
-			s.soket.handlers.receivedTextMessageHandler(s, message)
-		case websocket.BinaryMessage:
-			s.soket.handlers.receivedBinaryMessageHandler(s, message)
+		if s.soket.Config.TransferChunkSize > 0 && s.soket.handleTransfer(s, message) {
+			return true
 		}
+	case websocket.BinaryMessage:
+		if s.soket.Config.ChannelWindow > 0 {
+			s.receivedChannelFrame(message)
+			return true
+		}
+	}
+	return false
+}
+
+// touch records the activity of the client for the idle timeout.
+func (s *Session) touch() {
+	if s.soket.Config.IdleTimeout > 0 {
+		atomic.StoreInt64(&s.lastActivity, s.soket.now().UnixNano())
 	}
 }
 
 func (s *Session) close() {
+	s.stopTimers()
+	s.failDownloads()
+	s.resetChannels()
 	if err := s.socketAdapter.Close(); err != nil {
 		s.soket.handlers.errorHandler(s, err)
 	}
+	s.closeMutex.Lock()
 	s.closed = true
-	close(s.messageQueue)
+	for _, lane := range s.lanes() {
+		if lane != nil {
+			close(lane)
+		}
+	}
+	s.closeMutex.Unlock()
+	// the writer may have stopped on an error, whatever is left will never be written
+	for _, lane := range s.lanes() {
+		if lane == nil {
+			continue
+		}
+		for pck := range lane {
+			pck = s.takeConflated(pck)
+			s.decreaseCounter()
+			s.charge(-int64(len(pck.message)))
+			s.undelivered(pck, ErrSessionClosed)
+		}
+	}
+	// an on demand writer paused by the credits exits with the packet held, no writer is started anymore
+	// once the flag is taken
+	if s.onDemand && atomic.CompareAndSwapInt32(&s.writing, 0, 1) {
+		s.dropHeld()
+	}
+}
+
+// isClosed tells if the session was closed.
+func (s *Session) isClosed() bool {
+	s.closeMutex.RLock()
+	defer s.closeMutex.RUnlock()
+	return s.closed
 }
 
 func (s *Session) GetID() string {
 	return s.id
 }
 
+// SetUserID tells which user the session belongs to, messages to the user reach all of their sessions.
+// Call it in the function passed to HandleRequest, it has no effect after the session is registered.
+func (s *Session) SetUserID(userID string) {
+	s.userID = userID
+}
+
+func (s *Session) GetUserID() string {
+	return s.userID
+}
+
 func (s *Session) Set(key string, value interface{}) {
 	if s.keyVal == nil {
 		s.keyVal = make(map[string]interface{})
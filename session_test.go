@@ -49,6 +49,7 @@ func TestWriteMessageToPipe(t *testing.T) {
 	session := &Session{
 		messageQueue: make(chan *packet, 5),
 		soket: &Soket{
+			Config: &config.Config{},
 			grace: grace{
 				waitGroup: &sync.WaitGroup{},
 				counter:   0,
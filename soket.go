@@ -1,6 +1,7 @@
 package soket
 
 import (
+	"io"
 	"net/http"
 	"os"
 	"runtime"
@@ -19,32 +20,66 @@ type ISoket interface {
 	HandleRequest(http.ResponseWriter, *http.Request, func(*Session)) error
 	HandleRequestWithTags(http.ResponseWriter, *http.Request, map[string]struct{}, func(*Session)) error
 
+	Subscribe(*Session, ...string) error
+	Unsubscribe(*Session, ...string)
+
 	HandleConnect(sessionFunc)
 	HandleDisconnect(sessionFunc)
 	HandleError(sessionErrorFunc)
 	HandleReceivedTextMessage(sessionMessageFunc)
 	HandleReceivedBinaryMessage(sessionMessageFunc)
+	HandleReceivedStream(sessionStreamFunc)
+	HandleTransfer(TransferHandler)
+	HandleChannel(string, ChannelHandler)
 	HandleSentTextMessage(sessionMessageFunc)
 	HandleSentBinaryMessage(sessionMessageFunc)
 	HandleSentPingMessage(sessionMessageFunc)
+	HandleLatency(latencyFunc)
 	HandleClose(closeFunc)
+	HandleDeadLetter(deadLetterFunc)
+	HandleUndelivered(undeliveredFunc)
 
 	// TEXT MESSAGES
 	BroadcastTextToAll([]byte)
 	BroadcastTextTo([]byte, map[*Session]struct{})
-	BroadcastTextToTag([]byte, string)
+	BroadcastTextToTag([]byte, string, ...BroadcastOption)
+	BroadcastTextToTopic([]byte, string, ...BroadcastOption)
 	BroadcastTextWithFiltering([]byte, func(*Session) bool)
+	BroadcastTextToUser([]byte, string)
 
 	// BINARY MESSAGES
 	BroadcastBinaryToAll([]byte)
+	BroadcastBinaryTo([]byte, map[*Session]struct{})
 	BroadcastBinartyTo([]byte, map[*Session]struct{})
-	BroadcastBinaryToTag([]byte, string)
+	BroadcastBinaryToTag([]byte, string, ...BroadcastOption)
+	BroadcastBinaryToTopic([]byte, string, ...BroadcastOption)
 	BroadcastBinaryWithFiltering([]byte, func(*Session) bool)
+	BroadcastBinaryToUser([]byte, string)
 
 	BroadcastExit()
 	BroadcastExitTo(map[*Session]struct{})
 
+	// BUILDER
+	Broadcast([]byte) *BroadcastBuilder
+
+	SetHistoryStore(HistoryStore)
+	RecordHistory(string, HistoryRetention)
+	StopHistory(string)
+	History(string, time.Time, int) ([]HistoryMessage, error)
+	HistoryBefore(string, uint64, int) ([]HistoryMessage, error)
+
+	SetInboxStore(InboxStore)
+
+	SetTagTTL(string, time.Duration)
+	Metrics() Metrics
+	Stats() Stats
+	TagStats(string) Stats
+
+	ClearRetained(string)
+	ExpireRetained(string, time.Duration)
+
 	GetAllSessions() map[*Session]struct{}
+	CountTagExpr(TagExpr) int
 
 	Shutdown()
 }
@@ -55,10 +90,23 @@ type grace struct {
 }
 
 type Soket struct {
-	Config   *config.Config
-	haus     IHaus
-	handlers *handlers
-	grace    grace
+	// metrics is kept first for the alignment of its 64-bit counters
+	metrics   metrics
+	Config    *config.Config
+	haus      IHaus
+	handlers  *handlers
+	retained  *retainStore
+	history   *history
+	inbox     *inbox
+	expiry    *expiry
+	done      chan struct{}
+	shutdown  sync.Once
+	grace     grace
+	netpoll   *adapters.Netpoll
+	wheel     *wheel
+	reads     *readPool
+	transfers *transfers
+	departed  departedStats
 }
 
 type handlers struct {
@@ -70,22 +118,41 @@ type handlers struct {
 	errorHandler                 sessionErrorFunc
 	receivedTextMessageHandler   sessionMessageFunc
 	receivedBinaryMessageHandler sessionMessageFunc
+	receivedStreamHandler        sessionStreamFunc
+	transferHandler              TransferHandler
+	channelHandlers              map[string]ChannelHandler
 	sentTextMessageHandler       sessionMessageFunc
 	sentBinaryMessageHandler     sessionMessageFunc
 	sentPingMessageHandler       sessionMessageFunc
+	latencyHandler               latencyFunc
 	logHandler                   logFunc
+	deadLetterHandler            deadLetterFunc
+	undeliveredHandler           undeliveredFunc
 }
 
 type closeFunc func(int, string)
+type deadLetterFunc func(string, InboxMessage, error)
+type undeliveredFunc func(*Session, Message, error)
 type logFunc func(*Session, string)
 type pingPongFunc func(*Session, string)
 type sessionFunc func(*Session)
 type sessionErrorFunc func(*Session, error)
 type sessionMessageFunc func(*Session, []byte)
+type sessionStreamFunc func(*Session, int, io.Reader)
+type latencyFunc func(*Session, RTT, bool)
+
+var loggerOnce sync.Once
+
+// setupLogger points the global logger at the console, once for all the sokets of the process.
+func setupLogger() {
+	loggerOnce.Do(func() {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	})
+}
 
 // New creates a new soket instance.
 func New(configs ...config.ConfigParam) ISoket {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	setupLogger()
 	conf := config.LoadConfig(configs)
 	handlers := &handlers{
 		closeHandler:      func(int, string) {},
@@ -98,26 +165,53 @@ func New(configs ...config.ConfigParam) ISoket {
 		},
 		errorHandler: func(ses *Session, err error) {
 			_, fn, line, _ := runtime.Caller(1)
-			log.Error().Err(err).
-				Int("line", line).Str("function", fn).
-				Str("session_id", ses.GetID()).Msg("Error captured >>")
+			event := log.Error().Err(err).
+				Int("line", line).Str("function", fn)
+			if ses != nil {
+				event = event.Str("session_id", ses.GetID())
+			}
+			event.Msg("Error captured >>")
 		},
 		receivedTextMessageHandler:   func(*Session, []byte) {},
 		receivedBinaryMessageHandler: func(*Session, []byte) {},
 		sentTextMessageHandler:       func(*Session, []byte) {},
 		sentBinaryMessageHandler:     func(*Session, []byte) {},
 		sentPingMessageHandler:       func(*Session, []byte) {},
+		latencyHandler:               func(*Session, RTT, bool) {},
+		deadLetterHandler:            func(string, InboxMessage, error) {},
+		undeliveredHandler:           func(*Session, Message, error) {},
 	}
 	var waitGroup sync.WaitGroup
-	return &Soket{
-		haus:     newHaus(conf, handlers),
-		Config:   conf,
-		handlers: handlers,
+	s := &Soket{
+		haus:      newHaus(conf, handlers),
+		Config:    conf,
+		handlers:  handlers,
+		retained:  newRetainStore(),
+		history:   newHistory(),
+		inbox:     newInbox(),
+		expiry:    newExpiry(),
+		done:      make(chan struct{}),
+		wheel:     newWheel(conf),
+		reads:     newReadPool(conf),
+		transfers: newTransfers(),
 		grace: grace{
 			waitGroup: &waitGroup,
 			counter:   0,
 		},
 	}
+	go s.wheel.run(s.done)
+	if conf.InboxSize > 0 && conf.InboxTTL > 0 {
+		go s.sweepInbox()
+	}
+	if conf.NetpollWorkers > 0 {
+		netpoll, err := adapters.NewNetpoll(conf.NetpollWorkers)
+		if err != nil {
+			log.Error().Err(err).Msg("Cannot start netpoll, falling back to goroutines >>")
+		} else {
+			s.netpoll = netpoll
+		}
+	}
+	return s
 }
 
 // HandleRequest upgrades http requests to websocket connections, returns the session from the inner function.
@@ -126,42 +220,94 @@ func (s *Soket) HandleRequest(w http.ResponseWriter, r *http.Request, f func(*Se
 }
 
 // HandleRequestWithTags upgrades http requests to websocket connections, returns the session from the inner function. You can supply tags if you like to filter quickly.
+// With config.WithNetpoll it returns once the connection is handed to the event loop, otherwise once the connection ends.
 func (s *Soket) HandleRequestWithTags(w http.ResponseWriter, r *http.Request, tags map[string]struct{}, f func(*Session)) error {
 	if !s.haus.isOpen() {
 		return nil
 	}
-	gorillaSocket, err := adapters.NewGorillaSocket(w, r)
+	for tag := range tags {
+		if err := validateTopic(tag); err != nil {
+			return err
+		}
+	}
+	socket, err := s.upgrade(w, r)
 	if err != nil {
 		return err
 	}
 
-	session, err := initSession(gorillaSocket, r, s)
+	session, err := initSession(socket, r, s)
 	if err != nil {
 		return err
 	}
 
 	f(session.get())
 
-	s.haus.registerSession(session.get(), tags)
+	// notify client about the id of the session, ahead of the messages kept for its user
+	s.BroadcastTextTo(session.getInitialNotification())
+
+	s.register(session.get(), tags)
+
+	session.get().startTimers()
 
 	s.handlers.connectHandler(session.get())
 
-	go session.writeToSocket()
+	eventSocket, evented := socket.(adapters.EventSocket)
+	if !evented {
+		go session.writeToSocket()
+	}
 
-	// notify client about the id of the session
-	s.BroadcastTextTo(session.getInitialNotification())
+	s.deliverRetained(session.get(), tagList(tags))
+
+	if evented {
+		return session.serve(eventSocket)
+	}
 
 	session.readFromSocket()
 
+	s.disconnect(session.get())
+
+	return nil
+}
+
+// upgrade upgrades the request for the event loop if config.WithNetpoll is set, for gorilla otherwise.
+func (s *Soket) upgrade(w http.ResponseWriter, r *http.Request) (adapters.Socket, error) {
+	if s.netpoll == nil {
+		return adapters.NewGorillaSocket(w, r)
+	}
+	socket, err := s.netpoll.Upgrade(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return socket, nil
+}
+
+func (s *Soket) disconnect(session *Session) {
 	session.close()
 
-	s.haus.unregisterSession(session.get())
+	s.retire(session)
 
-	s.handlers.disconnectHandler(session.get())
+	s.handlers.disconnectHandler(session)
+}
 
+// Subscribe adds tags to a connected session. Tags may be hierarchical topics with wildcards, e.g. "prices.eq.*" or "prices.#".
+// Retained messages of the tags are delivered right after subscribing.
+// It returns ErrInvalidTopic and subscribes none of the tags if a wildcard is misplaced, e.g. "prices.#.eq" or "prices.eq*".
+func (s *Soket) Subscribe(session *Session, tags ...string) error {
+	for _, tag := range tags {
+		if err := validateTopic(tag); err != nil {
+			return err
+		}
+	}
+	s.haus.subscribe(session, tags)
+	s.deliverRetained(session, tags)
 	return nil
 }
 
+// Unsubscribe removes tags from a connected session.
+func (s *Soket) Unsubscribe(session *Session, tags ...string) {
+	s.haus.unsubscribe(session, tags)
+}
+
 // HandleConnect will be fired after upgrading request to a websocket connection.
 func (s *Soket) HandleConnect(f sessionFunc) {
 	s.handlers.connectHandler = f
@@ -173,6 +319,7 @@ func (s *Soket) HandleDisconnect(f sessionFunc) {
 }
 
 // HandleError will handle errors happened in the lifecycle of a websocket.
+// The session is nil for errors of the soket itself, e.g. a history or inbox store failing.
 func (s *Soket) HandleError(f sessionErrorFunc) {
 	s.handlers.errorHandler = f
 }
@@ -183,10 +330,26 @@ func (s *Soket) HandleReceivedTextMessage(f sessionMessageFunc) {
 }
 
 // HandleReceivedBinaryMessage will be fired after receiving a message as byte. This also has the related session.
+// With config.WithChannels binary messages are channel frames and never reach it.
 func (s *Soket) HandleReceivedBinaryMessage(f sessionMessageFunc) {
 	s.handlers.receivedBinaryMessageHandler = f
 }
 
+// HandleReceivedStream will be fired for every received message instead of the text and binary handlers,
+// with a reader of the message valid until the handler returns. The frames of the protocols enabled by the config,
+// e.g. heartbeats, credits, transfers and channels, are still handled and not passed on; a text message longer than
+// config.WithMaxMessageSize is passed on without looking at it.
+// Sockets implementing adapters.StreamReader are read without buffering the message, others hand over a reader of it.
+func (s *Soket) HandleReceivedStream(f sessionStreamFunc) {
+	s.handlers.receivedStreamHandler = f
+}
+
+// HandleTransfer will be fired for every file uploaded with the transfer protocol, see config.WithTransfers.
+// It runs in a goroutine of its own while the session reads on. Uploads are refused while no handler is set.
+func (s *Soket) HandleTransfer(f TransferHandler) {
+	s.handlers.transferHandler = f
+}
+
 // HandleSentTextMessage will be fired after the text message is sent.
 func (s *Soket) HandleSentTextMessage(f sessionMessageFunc) {
 	s.handlers.sentTextMessageHandler = f
@@ -202,6 +365,18 @@ func (s *Soket) HandleSentPingMessage(f sessionMessageFunc) {
 	s.handlers.sentPingMessageHandler = f
 }
 
+// HandleUndelivered will be fired for every message that cannot be delivered to a session.
+// The error is a *DeliveryError wrapping ErrQueueFull, ErrSessionClosed, ErrWriteTimeout or the write error.
+func (s *Soket) HandleUndelivered(f undeliveredFunc) {
+	s.handlers.undeliveredHandler = f
+}
+
+// HandleLatency will be fired when the average round trip of a session rises above config.WithRTTThreshold,
+// with true, and when it falls back below it, with false. It runs in the reading goroutine of the session.
+func (s *Soket) HandleLatency(f latencyFunc) {
+	s.handlers.latencyHandler = f
+}
+
 // HandleClose will be fired after the connection is closed.
 func (s *Soket) HandleClose(f closeFunc) {
 	s.handlers.closeHandler = f
@@ -209,23 +384,23 @@ func (s *Soket) HandleClose(f closeFunc) {
 
 // BroadcastExit broadcasts exit to every registered session.
 func (s *Soket) BroadcastExit() {
-	allSessions := s.haus.getAllSessions()
-	s.haus.broadcastTo(allSessions, &packet{
-		eType: websocket.CloseMessage,
+	s.haus.broadcastToAll(&packet{
+		eType:    websocket.CloseMessage,
+		priority: PriorityControl,
 	})
 }
 
 // BroadcastExitTo broadcasts exit to only selected sessions.
 func (s *Soket) BroadcastExitTo(sessions map[*Session]struct{}) {
 	s.haus.broadcastTo(sessions, &packet{
-		eType: websocket.CloseMessage,
+		eType:    websocket.CloseMessage,
+		priority: PriorityControl,
 	})
 }
 
 // BroadcastTextToAll broadcasts text message to every registered session.
 func (s *Soket) BroadcastTextToAll(message []byte) {
-	allSessions := s.haus.getAllSessions()
-	s.haus.broadcastTo(allSessions, &packet{
+	s.haus.broadcastToAll(&packet{
 		eType:   websocket.TextMessage,
 		message: message,
 	})
@@ -240,12 +415,14 @@ func (s *Soket) BroadcastTextTo(message []byte, sessions map[*Session]struct{})
 }
 
 // BroadcastTextToTag broadcasts text to sessions with tags.
-func (s *Soket) BroadcastTextToTag(message []byte, topic string) {
-	taggedSessions := s.haus.filterSessionsByTag(topic)
-	s.haus.broadcastTo(taggedSessions, &packet{
-		eType:   websocket.TextMessage,
-		message: message,
-	})
+// Pass Retain or RetainLast to deliver it to sessions joining the tag later on.
+func (s *Soket) BroadcastTextToTag(message []byte, topic string, options ...BroadcastOption) {
+	s.broadcastToTag(topic, websocket.TextMessage, message, loadBroadcastOptions(options))
+}
+
+// BroadcastTextToTopic broadcasts text to sessions subscribed to the topic, wildcard subscriptions included.
+func (s *Soket) BroadcastTextToTopic(message []byte, topic string, options ...BroadcastOption) {
+	s.haus.broadcastTo(s.haus.filterSessionsByTopic(topic), loadBroadcastOptions(options).packet(websocket.TextMessage, message))
 }
 
 // BroadcastTextWithFiltering broadcasts text to sessions that match with specified filter.
@@ -259,28 +436,36 @@ func (s *Soket) BroadcastTextWithFiltering(message []byte, filter func(*Session)
 
 // BroadcastBinaryToAll broadcasts binary message to all connected sessions.
 func (s *Soket) BroadcastBinaryToAll(message []byte) {
-	allSessions := s.haus.getAllSessions()
-	s.haus.broadcastTo(allSessions, &packet{
+	s.haus.broadcastToAll(&packet{
 		eType:   websocket.BinaryMessage,
 		message: message,
 	})
 }
 
-// BroadcastBinartyTo broadcasts binary message to only selected sessions.
-func (s *Soket) BroadcastBinartyTo(message []byte, sessions map[*Session]struct{}) {
+// BroadcastBinaryTo broadcasts binary message to only selected sessions.
+func (s *Soket) BroadcastBinaryTo(message []byte, sessions map[*Session]struct{}) {
 	s.haus.broadcastTo(sessions, &packet{
 		eType:   websocket.BinaryMessage,
 		message: message,
 	})
 }
 
+// BroadcastBinartyTo broadcasts binary message to only selected sessions.
+//
+// Deprecated: use BroadcastBinaryTo.
+func (s *Soket) BroadcastBinartyTo(message []byte, sessions map[*Session]struct{}) {
+	s.BroadcastBinaryTo(message, sessions)
+}
+
 // BroadcastBinaryToTag broadcasts binary message to sessions with tags.
-func (s *Soket) BroadcastBinaryToTag(message []byte, topic string) {
-	taggedSessions := s.haus.filterSessionsByTag(topic)
-	s.haus.broadcastTo(taggedSessions, &packet{
-		eType:   websocket.BinaryMessage,
-		message: message,
-	})
+// Pass Retain or RetainLast to deliver it to sessions joining the tag later on.
+func (s *Soket) BroadcastBinaryToTag(message []byte, topic string, options ...BroadcastOption) {
+	s.broadcastToTag(topic, websocket.BinaryMessage, message, loadBroadcastOptions(options))
+}
+
+// BroadcastBinaryToTopic broadcasts binary message to sessions subscribed to the topic, wildcard subscriptions included.
+func (s *Soket) BroadcastBinaryToTopic(message []byte, topic string, options ...BroadcastOption) {
+	s.haus.broadcastTo(s.haus.filterSessionsByTopic(topic), loadBroadcastOptions(options).packet(websocket.BinaryMessage, message))
 }
 
 // BroadcastBinaryWithFiltering broadcasts binary message to sessions that match with specified filter.
@@ -297,9 +482,19 @@ func (s *Soket) GetAllSessions() map[*Session]struct{} {
 	return s.haus.getAllSessions()
 }
 
-// Shutdown gracefully shutdowns the server.
+// CountTagExpr returns how many sessions match the tag expression without sending anything, a nil expression matches none.
+func (s *Soket) CountTagExpr(expr TagExpr) int {
+	return len(s.haus.filterSessionsByTagExpr(expr))
+}
+
+// Shutdown gracefully shutdowns the server, calling it again waits for the first call to finish.
 func (s *Soket) Shutdown() {
+	s.shutdown.Do(s.shutdownOnce)
+}
+
+func (s *Soket) shutdownOnce() {
 	s.haus.close()
+	close(s.done)
 	s.BroadcastExit()
 	go func() {
 		var lastCount int32
@@ -313,6 +508,28 @@ func (s *Soket) Shutdown() {
 		}
 	}()
 	s.grace.waitGroup.Wait()
+	if s.netpoll != nil {
+		s.netpoll.Close()
+	}
+}
+
+func (s *Soket) broadcastToTag(topic string, eType int, message []byte, options *broadcastOptions) {
+	if options.ttl == 0 {
+		options.ttl = s.expiry.shortest([]string{topic})
+	}
+	pck := options.packet(eType, message)
+	s.retained.retain(topic, pck, options)
+	s.recordHistory(topic, pck)
+	taggedSessions := s.haus.filterSessionsByTag(topic)
+	s.haus.broadcastTo(taggedSessions, pck)
+}
+
+func tagList(tags map[string]struct{}) []string {
+	list := make([]string, 0, len(tags))
+	for tag := range tags {
+		list = append(list, tag)
+	}
+	return list
 }
 
 const (
@@ -84,3 +84,9 @@ func TestSoket(t *testing.T) {
 
 	websocketClient.Close()
 }
+
+func TestShutdownTwice(t *testing.T) {
+	s := New()
+	s.Shutdown()
+	assert.NotPanics(t, s.Shutdown)
+}
@@ -0,0 +1,231 @@
+package soket
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Stats is a snapshot of the traffic of a session, or of the sessions of a tag or a soket rolled up.
+type Stats struct {
+	// Sessions is the number of sessions rolled up, one for a session
+	Sessions int
+	// ConnectedAt is when the session connected, the earliest connection of a roll up
+	ConnectedAt time.Time
+	// LastReceived and LastSent are when a message was last read from the client and written to it
+	LastReceived time.Time
+	LastSent     time.Time
+	// In is what the client sent, Out what was written to it
+	In  Traffic
+	Out Traffic
+	// QueueDepth is the number of messages waiting to be written, QueueHighWater the most that ever waited at once,
+	// the highest session of a roll up
+	QueueDepth     int
+	QueueHighWater int
+	// Dropped counts the messages that were not delivered, see HandleUndelivered
+	Dropped uint64
+	// Pings counts the pings written and Pongs the pongs read
+	Pings uint64
+	Pongs uint64
+}
+
+// Traffic counts the messages of one direction by their type, control messages are pings, pongs and closes.
+type Traffic struct {
+	Text    Count
+	Binary  Count
+	Control Count
+}
+
+// Count is a number of messages and their size in bytes.
+type Count struct {
+	Messages uint64
+	Bytes    uint64
+}
+
+// Total adds up the messages of every type.
+func (t Traffic) Total() Count {
+	return Count{
+		Messages: t.Text.Messages + t.Binary.Messages + t.Control.Messages,
+		Bytes:    t.Text.Bytes + t.Binary.Bytes + t.Control.Bytes,
+	}
+}
+
+const (
+	kindText = iota
+	kindBinary
+	kindControl
+	kinds
+)
+
+// sessionStats holds only 64-bit counters so they stay aligned where the session keeps it.
+type sessionStats struct {
+	connectedAt  int64
+	lastReceived int64
+	lastSent     int64
+	in           [kinds]counter
+	out          [kinds]counter
+	highWater    int64
+	dropped      uint64
+	pings        uint64
+	pongs        uint64
+}
+
+type counter struct {
+	messages uint64
+	bytes    uint64
+}
+
+func (c *counter) add(size int) {
+	atomic.AddUint64(&c.messages, 1)
+	atomic.AddUint64(&c.bytes, uint64(size))
+}
+
+func (c *counter) load() Count {
+	return Count{Messages: atomic.LoadUint64(&c.messages), Bytes: atomic.LoadUint64(&c.bytes)}
+}
+
+func kind(eType int) int {
+	switch eType {
+	case websocket.TextMessage:
+		return kindText
+	case websocket.BinaryMessage:
+		return kindBinary
+	}
+	return kindControl
+}
+
+// countIn records a message read from the client.
+func (s *Session) countIn(eType int, size int) {
+	s.stats.in[kind(eType)].add(size)
+	atomic.StoreInt64(&s.stats.lastReceived, s.soket.now().UnixNano())
+}
+
+// countOut records a message written to the client.
+func (s *Session) countOut(eType int, size int) {
+	s.stats.out[kind(eType)].add(size)
+	atomic.StoreInt64(&s.stats.lastSent, s.soket.now().UnixNano())
+}
+
+// queued raises the high-water mark of the queues to their current depth.
+func (s *Session) queued() {
+	depth := int64(s.pending())
+	for {
+		highWater := atomic.LoadInt64(&s.stats.highWater)
+		if depth <= highWater || atomic.CompareAndSwapInt64(&s.stats.highWater, highWater, depth) {
+			return
+		}
+	}
+}
+
+// countingReader counts the bytes of a received stream as the stream handler reads them.
+type countingReader struct {
+	reader  io.Reader
+	counter *counter
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	atomic.AddUint64(&c.counter.bytes, uint64(n))
+	return n, err
+}
+
+// Stats returns the traffic of the session so far.
+func (s *Session) Stats() Stats {
+	stats := Stats{
+		Sessions:       1,
+		ConnectedAt:    unixTime(atomic.LoadInt64(&s.stats.connectedAt)),
+		LastReceived:   unixTime(atomic.LoadInt64(&s.stats.lastReceived)),
+		LastSent:       unixTime(atomic.LoadInt64(&s.stats.lastSent)),
+		QueueDepth:     s.pending(),
+		QueueHighWater: int(atomic.LoadInt64(&s.stats.highWater)),
+		Dropped:        atomic.LoadUint64(&s.stats.dropped),
+		Pings:          atomic.LoadUint64(&s.stats.pings),
+		Pongs:          atomic.LoadUint64(&s.stats.pongs),
+	}
+	stats.In = Traffic{Text: s.stats.in[kindText].load(), Binary: s.stats.in[kindBinary].load(), Control: s.stats.in[kindControl].load()}
+	stats.Out = Traffic{Text: s.stats.out[kindText].load(), Binary: s.stats.out[kindBinary].load(), Control: s.stats.out[kindControl].load()}
+	return stats
+}
+
+// unixTime turns a counter of nanoseconds into a time, zero stays the zero time.
+func unixTime(nanoseconds int64) time.Time {
+	if nanoseconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanoseconds)
+}
+
+// departedStats keeps the traffic of the sessions that disconnected, so the stats of the soket keep counting it.
+type departedStats struct {
+	mutex sync.Mutex
+	stats Stats
+}
+
+// retire unregisters a closed session and keeps its traffic for the stats of the soket.
+func (s *Soket) retire(session *Session) {
+	stats := session.Stats()
+	// what the session does now is not carried over, nor does it count as a session
+	stats.Sessions, stats.ConnectedAt, stats.QueueDepth = 0, time.Time{}, 0
+	s.departed.mutex.Lock()
+	defer s.departed.mutex.Unlock()
+	s.haus.unregisterSession(session)
+	s.departed.stats.rollIn(stats)
+}
+
+// Stats rolls up the traffic of the soket so far, the sessions that disconnected included.
+// Sessions, ConnectedAt and QueueDepth are of the connected sessions.
+func (s *Soket) Stats() Stats {
+	s.departed.mutex.Lock()
+	defer s.departed.mutex.Unlock()
+	stats := rollUp(s.haus.getAllSessions())
+	stats.rollIn(s.departed.stats)
+	return stats
+}
+
+// TagStats rolls up the traffic of the sessions connected with the tag, e.g. to find the chatty clients of a room.
+// Unlike Stats, sessions that disconnected or left the tag are not counted anymore.
+func (s *Soket) TagStats(tag string) Stats {
+	return rollUp(s.haus.filterSessionsByTag(tag))
+}
+
+func rollUp(sessions map[*Session]struct{}) Stats {
+	var rolled Stats
+	for session := range sessions {
+		rolled.rollIn(session.Stats())
+	}
+	return rolled
+}
+
+// rollIn adds the stats of a session, or of sessions already rolled up.
+func (r *Stats) rollIn(stats Stats) {
+	r.Sessions += stats.Sessions
+	if r.ConnectedAt.IsZero() || (!stats.ConnectedAt.IsZero() && stats.ConnectedAt.Before(r.ConnectedAt)) {
+		r.ConnectedAt = stats.ConnectedAt
+	}
+	if stats.LastReceived.After(r.LastReceived) {
+		r.LastReceived = stats.LastReceived
+	}
+	if stats.LastSent.After(r.LastSent) {
+		r.LastSent = stats.LastSent
+	}
+	r.In = r.In.add(stats.In)
+	r.Out = r.Out.add(stats.Out)
+	r.QueueDepth += stats.QueueDepth
+	if stats.QueueHighWater > r.QueueHighWater {
+		r.QueueHighWater = stats.QueueHighWater
+	}
+	r.Dropped += stats.Dropped
+	r.Pings += stats.Pings
+	r.Pongs += stats.Pongs
+}
+
+func (t Traffic) add(other Traffic) Traffic {
+	return Traffic{Text: t.Text.add(other.Text), Binary: t.Binary.add(other.Binary), Control: t.Control.add(other.Control)}
+}
+
+func (c Count) add(other Count) Count {
+	return Count{Messages: c.Messages + other.Messages, Bytes: c.Bytes + other.Bytes}
+}
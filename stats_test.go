@@ -0,0 +1,115 @@
+package soket
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionStats(t *testing.T) {
+	s := New().(*Soket)
+	defer close(s.done)
+	received := make(chan struct{}, 1)
+	s.HandleReceivedTextMessage(func(*Session, []byte) {
+		received <- struct{}{}
+	})
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	<-received
+	assert.Nil(t, session.writeMessageToPipe(&packet{eType: websocket.BinaryMessage, message: []byte("abc")}))
+	_, message, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(message))
+
+	stats := session.Stats()
+	assert.Equal(t, 1, stats.Sessions)
+	assert.False(t, stats.ConnectedAt.IsZero())
+	assert.False(t, stats.LastReceived.Before(stats.ConnectedAt))
+	assert.Equal(t, Count{Messages: 1, Bytes: 5}, stats.In.Text)
+	assert.Equal(t, Count{Messages: 1, Bytes: 3}, stats.Out.Binary)
+	// the notification with the session id
+	assert.Equal(t, uint64(1), stats.Out.Text.Messages)
+	assert.Equal(t, uint64(2), stats.Out.Total().Messages)
+	assert.GreaterOrEqual(t, stats.QueueHighWater, 1)
+}
+
+func TestStatsRollUp(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.handlers.undeliveredHandler = func(*Session, Message, error) {}
+	s.handlers.errorHandler = func(*Session, error) {}
+	s.handlers.receivedTextMessageHandler = func(*Session, []byte) {}
+	s.handlers.receivedBinaryMessageHandler = func(*Session, []byte) {}
+	s.handlers.sentPingMessageHandler = func(*Session, []byte) {}
+	first := newBroadcastTestSession(s, "1", 2, "room")
+	second := newBroadcastTestSession(s, "2", 2, "room")
+	other := newBroadcastTestSession(s, "3", 2, "lobby")
+
+	first.received(websocket.TextMessage, []byte("chatty"))
+	first.received(websocket.TextMessage, []byte("chatty"))
+	second.received(websocket.BinaryMessage, []byte("bin"))
+	other.received(websocket.TextMessage, []byte("quiet"))
+	for i := 0; i < 3; i++ {
+		first.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("x")})
+	}
+	first.sent(&packet{eType: websocket.PingMessage, message: make([]byte, 8)})
+
+	firstStats := first.Stats()
+	assert.Equal(t, 2, firstStats.QueueDepth)
+	assert.Equal(t, 2, firstStats.QueueHighWater)
+	assert.Equal(t, uint64(1), firstStats.Dropped)
+	assert.Equal(t, uint64(1), firstStats.Pings)
+	assert.Equal(t, Count{Messages: 1, Bytes: 8}, firstStats.Out.Control)
+
+	room := s.TagStats("room")
+	assert.Equal(t, 2, room.Sessions)
+	assert.Equal(t, Count{Messages: 2, Bytes: 12}, room.In.Text)
+	assert.Equal(t, Count{Messages: 1, Bytes: 3}, room.In.Binary)
+	assert.Equal(t, 2, room.QueueDepth)
+	assert.Equal(t, uint64(1), room.Dropped)
+
+	all := s.Stats()
+	assert.Equal(t, 3, all.Sessions)
+	assert.Equal(t, Count{Messages: 4, Bytes: 20}, all.In.Total())
+	assert.False(t, all.LastReceived.IsZero())
+	assert.True(t, all.ConnectedAt.IsZero())
+}
+
+func TestStatsKeepDisconnectedSessions(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.handlers.receivedTextMessageHandler = func(*Session, []byte) {}
+	gone := newBroadcastTestSession(s, "1", 2, "room")
+	stays := newBroadcastTestSession(s, "2", 2, "room")
+	gone.received(websocket.TextMessage, []byte("bye"))
+	stays.received(websocket.TextMessage, []byte("hi"))
+
+	s.retire(gone)
+
+	all := s.Stats()
+	assert.Equal(t, 1, all.Sessions)
+	assert.Equal(t, Count{Messages: 2, Bytes: 5}, all.In.Text)
+	assert.Equal(t, stays.Stats().ConnectedAt, all.ConnectedAt)
+	room := s.TagStats("room")
+	assert.Equal(t, 1, room.Sessions)
+	assert.Equal(t, Count{Messages: 1, Bytes: 2}, room.In.Text)
+}
+
+func TestStreamStats(t *testing.T) {
+	s := New(config.WithStreaming(1<<20, 1<<20)).(*Soket)
+	defer close(s.done)
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.SendStream(websocket.BinaryMessage, bytes.NewReader(make([]byte, 3000)))
+	}()
+	_, _, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Nil(t, <-sent)
+	assert.Equal(t, Count{Messages: 1, Bytes: 3000}, session.Stats().Out.Binary)
+}
@@ -0,0 +1,172 @@
+// Package boltstore keeps soket data in a BoltDB file.
+package boltstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/soket"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	historyBucket = []byte("history")
+	// maxAgeBucket keeps the MaxAge of the tags, so queries leave out what Append has not pruned yet
+	maxAgeBucket = []byte("history_max_age")
+)
+
+// Store implements soket.HistoryStore on top of a bolt database, every tag is a bucket keyed by the message ID.
+// Retention is applied when a message is appended to the tag, queries leave out the messages older than MaxAge.
+type Store struct {
+	db *bolt.DB
+}
+
+type record struct {
+	Type    int       `json:"type"`
+	Message []byte    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// New creates a store on an opened bolt database, the caller closes the database.
+func New(db *bolt.DB) (*Store, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(maxAgeBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func encodeID(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// Append records the message and drops the messages out of the retention.
+func (s *Store) Append(tag string, message *soket.HistoryMessage, retention soket.HistoryRetention) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(tag))
+		if err != nil {
+			return err
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(record{Type: message.Type, Message: message.Message, Time: message.Time})
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(encodeID(id), value); err != nil {
+			return err
+		}
+		message.ID = id
+		if err := putMaxAge(tx.Bucket(maxAgeBucket), tag, retention.MaxAge); err != nil {
+			return err
+		}
+		return prune(bucket, retention, id, message.Time)
+	})
+}
+
+func putMaxAge(bucket *bolt.Bucket, tag string, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		return bucket.Delete([]byte(tag))
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(maxAge))
+	return bucket.Put([]byte(tag), value)
+}
+
+// cutoff returns the time before which the messages of the tag are left out of a query.
+func cutoff(bucket *bolt.Bucket, tag string, since time.Time) time.Time {
+	value := bucket.Get([]byte(tag))
+	if value == nil {
+		return since
+	}
+	if expired := time.Now().Add(-time.Duration(binary.BigEndian.Uint64(value))); expired.After(since) {
+		return expired
+	}
+	return since
+}
+
+// prune deletes the oldest messages while there are more than MaxCount or they are older than MaxAge.
+// Messages are only deleted from the start, so the IDs in a bucket are contiguous up to lastID.
+func prune(bucket *bolt.Bucket, retention soket.HistoryRetention, lastID uint64, now time.Time) error {
+	var expiredKeys [][]byte
+	cursor := bucket.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		count := lastID - binary.BigEndian.Uint64(key) + 1
+		expired := retention.MaxCount > 0 && count > uint64(retention.MaxCount)
+		if !expired && retention.MaxAge > 0 {
+			var r record
+			if err := json.Unmarshal(value, &r); err != nil {
+				return err
+			}
+			expired = r.Time.Before(now.Add(-retention.MaxAge))
+		}
+		if !expired {
+			break
+		}
+		expiredKeys = append(expiredKeys, key)
+	}
+	for _, key := range expiredKeys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the latest messages of the tag matching the query, oldest first.
+func (s *Store) Query(tag string, query soket.HistoryQuery) ([]soket.HistoryMessage, error) {
+	var messages []soket.HistoryMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(tag))
+		if bucket == nil {
+			return nil
+		}
+		since := cutoff(tx.Bucket(maxAgeBucket), tag, query.Since)
+		cursor := bucket.Cursor()
+		var key, value []byte
+		if query.BeforeID > 0 {
+			key, value = cursor.Seek(encodeID(query.BeforeID))
+			if key == nil {
+				key, value = cursor.Last()
+			} else {
+				key, value = cursor.Prev()
+			}
+		} else {
+			key, value = cursor.Last()
+		}
+		for ; key != nil; key, value = cursor.Prev() {
+			if query.Limit > 0 && len(messages) == query.Limit {
+				break
+			}
+			var r record
+			if err := json.Unmarshal(value, &r); err != nil {
+				return err
+			}
+			if r.Time.Before(since) {
+				break
+			}
+			messages = append(messages, soket.HistoryMessage{
+				ID:      binary.BigEndian.Uint64(key),
+				Type:    r.Type,
+				Message: r.Message,
+				Time:    r.Time,
+			})
+		}
+		return nil
+	})
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, err
+}
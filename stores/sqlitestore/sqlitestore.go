@@ -0,0 +1,148 @@
+// Package sqlitestore keeps soket data in a SQLite database.
+// It works with any database/sql driver for SQLite, e.g. github.com/mattn/go-sqlite3.
+package sqlitestore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/soket"
+)
+
+const (
+	createHistoryTable = `CREATE TABLE IF NOT EXISTS soket_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tag TEXT NOT NULL,
+		type INTEGER NOT NULL,
+		message BLOB,
+		created_at INTEGER NOT NULL
+	)`
+	createHistoryIndex = `CREATE INDEX IF NOT EXISTS soket_history_tag_id ON soket_history (tag, id)`
+
+	// the MaxAge of the tags, so queries leave out what Append has not pruned yet
+	createMaxAgeTable = `CREATE TABLE IF NOT EXISTS soket_history_max_age (
+		tag TEXT PRIMARY KEY,
+		max_age INTEGER NOT NULL
+	)`
+
+	insertHistory = `INSERT INTO soket_history (tag, type, message, created_at) VALUES (?, ?, ?, ?)`
+
+	upsertMaxAge = `INSERT INTO soket_history_max_age (tag, max_age) VALUES (?, ?)
+		ON CONFLICT (tag) DO UPDATE SET max_age = excluded.max_age`
+
+	deleteMaxAge = `DELETE FROM soket_history_max_age WHERE tag = ?`
+
+	selectMaxAge = `SELECT max_age FROM soket_history_max_age WHERE tag = ?`
+
+	pruneHistoryByAge = `DELETE FROM soket_history WHERE tag = ? AND created_at < ?`
+
+	pruneHistoryByCount = `DELETE FROM soket_history WHERE tag = ? AND id <= (
+		SELECT id FROM soket_history WHERE tag = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+	)`
+
+	selectHistory = `SELECT id, type, message, created_at FROM soket_history
+		WHERE tag = ? AND created_at >= ? AND id < ? ORDER BY id DESC LIMIT ?`
+)
+
+// Store implements soket.HistoryStore on a SQLite table, message IDs are the row IDs.
+// Retention is applied when a message is appended to the tag, queries leave out the messages older than MaxAge.
+type Store struct {
+	db *sql.DB
+}
+
+// New creates the tables if needed, the caller closes the database.
+func New(db *sql.DB) (*Store, error) {
+	for _, statement := range []string{createHistoryTable, createHistoryIndex, createMaxAgeTable} {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{db: db}, nil
+}
+
+// Append records the message and drops the messages out of the retention.
+func (s *Store) Append(tag string, message *soket.HistoryMessage, retention soket.HistoryRetention) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(insertHistory, tag, message.Type, message.Message, message.Time.UnixNano())
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if retention.MaxAge > 0 {
+		_, err = tx.Exec(upsertMaxAge, tag, int64(retention.MaxAge))
+	} else {
+		_, err = tx.Exec(deleteMaxAge, tag)
+	}
+	if err != nil {
+		return err
+	}
+	if retention.MaxAge > 0 {
+		if _, err := tx.Exec(pruneHistoryByAge, tag, message.Time.Add(-retention.MaxAge).UnixNano()); err != nil {
+			return err
+		}
+	}
+	if retention.MaxCount > 0 {
+		if _, err := tx.Exec(pruneHistoryByCount, tag, tag, retention.MaxCount); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	message.ID = uint64(id)
+	return nil
+}
+
+// Query returns the latest messages of the tag matching the query, oldest first.
+func (s *Store) Query(tag string, query soket.HistoryQuery) ([]soket.HistoryMessage, error) {
+	var since int64
+	if !query.Since.IsZero() {
+		since = query.Since.UnixNano()
+	}
+	var maxAge int64
+	if err := s.db.QueryRow(selectMaxAge, tag).Scan(&maxAge); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if maxAge > 0 {
+		if expired := time.Now().Add(-time.Duration(maxAge)).UnixNano(); expired > since {
+			since = expired
+		}
+	}
+	beforeID := int64(^uint64(0) >> 1)
+	if query.BeforeID > 0 {
+		beforeID = int64(query.BeforeID)
+	}
+	limit := -1
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
+	rows, err := s.db.Query(selectHistory, tag, since, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []soket.HistoryMessage
+	for rows.Next() {
+		var message soket.HistoryMessage
+		var createdAt int64
+		if err := rows.Scan(&message.ID, &message.Type, &message.Message, &createdAt); err != nil {
+			return nil, err
+		}
+		message.Time = time.Unix(0, createdAt)
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
@@ -0,0 +1,82 @@
+package sqlitestore
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/soket"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStore(t *testing.T) *Store {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "soket.db"))
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	store, err := New(db)
+	assert.Nil(t, err)
+	return store
+}
+
+func messageTexts(messages []soket.HistoryMessage) []string {
+	texts := make([]string, len(messages))
+	for i, message := range messages {
+		texts[i] = string(message.Message)
+	}
+	return texts
+}
+
+func TestAppendQuery(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+	for i, text := range []string{"1", "2", "3", "4"} {
+		message := &soket.HistoryMessage{Type: 1, Message: []byte(text), Time: now.Add(time.Duration(i) * time.Second)}
+		assert.Nil(t, store.Append("room", message, soket.HistoryRetention{MaxCount: 3}))
+		assert.NotZero(t, message.ID)
+	}
+
+	messages, err := store.Query("room", soket.HistoryQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2", "3", "4"}, messageTexts(messages))
+
+	messages, err = store.Query("room", soket.HistoryQuery{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3", "4"}, messageTexts(messages))
+
+	messages, err = store.Query("room", soket.HistoryQuery{BeforeID: 4, Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3"}, messageTexts(messages))
+
+	messages, err = store.Query("room", soket.HistoryQuery{Since: now.Add(2 * time.Second)})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3", "4"}, messageTexts(messages))
+
+	messages, err = store.Query("other", soket.HistoryQuery{})
+	assert.Nil(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestRetentionByAge(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now()
+	retention := soket.HistoryRetention{MaxAge: time.Minute}
+	assert.Nil(t, store.Append("room", &soket.HistoryMessage{Message: []byte("old"), Time: now.Add(-time.Hour)}, retention))
+	assert.Nil(t, store.Append("room", &soket.HistoryMessage{Message: []byte("new"), Time: now}, retention))
+
+	messages, err := store.Query("room", soket.HistoryQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"new"}, messageTexts(messages))
+}
+
+func TestQueryLeavesOutExpired(t *testing.T) {
+	store := newTestStore(t)
+	retention := soket.HistoryRetention{MaxAge: 50 * time.Millisecond}
+	assert.Nil(t, store.Append("room", &soket.HistoryMessage{Message: []byte("old"), Time: time.Now()}, retention))
+	time.Sleep(60 * time.Millisecond)
+
+	messages, err := store.Query("room", soket.HistoryQuery{})
+	assert.Nil(t, err)
+	assert.Empty(t, messages)
+}
@@ -0,0 +1,88 @@
+package soket
+
+import (
+	"io"
+	"time"
+
+	"github.com/soket/adapters"
+)
+
+// stream is the body of a message sent with SendStream, done gets the outcome once it is written or dropped.
+type stream struct {
+	reader  io.Reader
+	done    chan error
+	written int64
+}
+
+// SendStream sends the data read from r until io.EOF as a single message, written in fragments
+// so it is never held in memory whole. It is queued behind the messages already queued and blocks
+// until it is written, the error tells why it could not be, e.g. ErrStreamTooLarge, see config.WithStreaming.
+// A stream failing halfway cannot be ended, the connection is closed then. The sent handlers are not fired for streams,
+// and SendStream must not be called from them.
+func (s *Session) SendStream(messageType int, r io.Reader) error {
+	pck := &packet{
+		eType:  messageType,
+		stream: &stream{reader: r, done: make(chan error, 1)},
+	}
+	if err := s.writeMessageToPipe(pck); err != nil {
+		return err
+	}
+	return <-pck.stream.done
+}
+
+// writeStream copies the stream into the fragments of one message, moving the write deadline for every fragment.
+// Sockets that cannot write fragments get the message in one piece.
+func (s *Session) writeStream(pck *packet) error {
+	r := pck.stream.reader
+	limit := s.soket.Config.StreamWriteLimit
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	socket, ok := s.socketAdapter.(adapters.StreamWriter)
+	if !ok {
+		message, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if limit > 0 && int64(len(message)) > limit {
+			return ErrStreamTooLarge
+		}
+		pck.stream.written = int64(len(message))
+		return s.socketAdapter.WriteMessage(pck.eType, message)
+	}
+	w, err := socket.NextWriter(pck.eType)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(deadlineWriter{session: s, writer: w}, r)
+	pck.stream.written = written
+	if err == nil && limit > 0 && written > limit {
+		err = ErrStreamTooLarge
+	}
+	if err != nil {
+		// ending the message would deliver it truncated
+		_ = s.socketAdapter.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// deadlineWriter gives every write of a stream the full write period.
+type deadlineWriter struct {
+	session *Session
+	writer  io.Writer
+}
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	if err := d.session.socketAdapter.SetWriteDeadline(time.Now().Add(d.session.soket.Config.WritePeriod)); err != nil {
+		return 0, err
+	}
+	return d.writer.Write(p)
+}
+
+// finish reports the outcome of a stream to SendStream.
+func (pck *packet) finish(err error) {
+	if pck.stream != nil {
+		pck.stream.done <- err
+	}
+}
@@ -0,0 +1,133 @@
+package soket
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func dialTestSoket(t *testing.T, s *Soket) (*websocket.Conn, *Session, func()) {
+	return dialTestSoketAs(t, s, "")
+}
+
+// dialTestSoketAs connects a session of the user, an empty user id leaves it anonymous.
+func dialTestSoketAs(t *testing.T, s *Soket, userID string) (*websocket.Conn, *Session, func()) {
+	connected := make(chan *Session, 1)
+	s.HandleConnect(func(session *Session) {
+		connected <- session
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, s.HandleRequest(w, r, func(session *Session) {
+			session.SetUserID(userID)
+		}))
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// the notification with the session id
+	_, _, err = conn.ReadMessage()
+	assert.Nil(t, err)
+	return conn, <-connected, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestSendStream(t *testing.T) {
+	s := New(config.WithStreaming(1<<20, 1<<20)).(*Soket)
+	defer s.Shutdown()
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	payload := bytes.Repeat([]byte("0123456789"), 30000)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.SendStream(websocket.BinaryMessage, bytes.NewReader(payload))
+	}()
+	messageType, message, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.BinaryMessage, messageType)
+	assert.Equal(t, payload, message)
+	assert.Nil(t, <-sent)
+}
+
+func TestSendStreamTooLarge(t *testing.T) {
+	s := New(config.WithStreaming(1<<20, 1000)).(*Soket)
+	defer s.Shutdown()
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	err := session.SendStream(websocket.BinaryMessage, bytes.NewReader(make([]byte, 5000)))
+	assert.Equal(t, ErrStreamTooLarge, err)
+	// the truncated message is never ended
+	_, _, err = conn.ReadMessage()
+	assert.NotNil(t, err)
+}
+
+func TestReceiveStream(t *testing.T) {
+	s := New(config.WithMaxMessageSize(16), config.WithStreaming(1<<20, 1<<20)).(*Soket)
+	defer s.Shutdown()
+	received := make(chan int, 1)
+	s.HandleReceivedStream(func(session *Session, messageType int, r io.Reader) {
+		n, err := io.Copy(io.Discard, r)
+		assert.Nil(t, err)
+		received <- int(n)
+	})
+	conn, _, done := dialTestSoket(t, s)
+	defer done()
+
+	assert.Nil(t, conn.WriteMessage(websocket.BinaryMessage, make([]byte, 100000)))
+	select {
+	case n := <-received:
+		assert.Equal(t, 100000, n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not received")
+	}
+}
+
+func TestSendStreamWithoutNextWriter(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.StreamWriteLimit = 8
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &recordingAdapter{}
+	session.socketAdapter = adapter
+	go session.writeToSocket()
+
+	assert.Nil(t, session.SendStream(websocket.TextMessage, strings.NewReader("in piece")))
+	assert.Equal(t, []packet{{eType: websocket.TextMessage, message: []byte("in piece")}}, adapter.written)
+	assert.Equal(t, ErrStreamTooLarge, session.SendStream(websocket.TextMessage, strings.NewReader("too large")))
+	assert.Len(t, adapter.written, 1)
+}
+
+func TestStreamsAreNotBatched(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.BatchMaxMessages = 10
+	s.handlers.sentTextMessageHandler = func(*Session, []byte) {}
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &recordingAdapter{}
+	session.socketAdapter = adapter
+
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("1")})
+	streamed := &packet{eType: websocket.TextMessage, stream: &stream{reader: strings.NewReader("2"), done: make(chan error, 1)}}
+	session.writeMessageToPipe(streamed)
+	session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: []byte("3")})
+	close(session.messageQueue)
+	session.writeToSocket()
+
+	assert.Nil(t, <-streamed.stream.done)
+	assert.Equal(t, []packet{
+		{eType: websocket.TextMessage, message: []byte("1")},
+		{eType: websocket.TextMessage, message: []byte("2")},
+		{eType: websocket.TextMessage, message: []byte("3")},
+	}, adapter.written)
+}
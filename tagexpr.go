@@ -0,0 +1,245 @@
+package soket
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TagExpr is a set expression over session tags, e.g. sessions tagged "region:eu" and "plan:pro" but not "muted".
+// It is evaluated against the tag index, only a negation without any positive tag needs every session.
+// Build it with Tag, And, Or, Not or parse it from a string with ParseTagExpr. A nil expression matches no session.
+type TagExpr interface {
+	// eval returns a new set, callers are free to modify it.
+	eval(*haus) map[*Session]struct{}
+	String() string
+}
+
+type tagExpr string
+
+type andExpr []TagExpr
+
+type orExpr []TagExpr
+
+type notExpr struct {
+	expr TagExpr
+}
+
+// Tag matches sessions having the tag.
+func Tag(tag string) TagExpr {
+	return tagExpr(tag)
+}
+
+// And matches sessions matching every expression.
+func And(exprs ...TagExpr) TagExpr {
+	return andExpr(exprs)
+}
+
+// Or matches sessions matching any of the expressions.
+func Or(exprs ...TagExpr) TagExpr {
+	return orExpr(exprs)
+}
+
+// Not matches sessions not matching the expression.
+func Not(expr TagExpr) TagExpr {
+	return notExpr{expr: expr}
+}
+
+// evalTagExpr evaluates an operand, a nil one is the empty set.
+func evalTagExpr(expr TagExpr, h *haus) map[*Session]struct{} {
+	if expr == nil {
+		return make(map[*Session]struct{})
+	}
+	return expr.eval(h)
+}
+
+func tagExprString(expr TagExpr) string {
+	if expr == nil {
+		return "()"
+	}
+	return expr.String()
+}
+
+func (e tagExpr) eval(h *haus) map[*Session]struct{} {
+	return h.filterSessionsByTag(string(e))
+}
+
+func (e tagExpr) String() string {
+	return string(e)
+}
+
+// eval intersects the positive expressions starting from the smallest one, then subtracts the negated ones.
+func (e andExpr) eval(h *haus) map[*Session]struct{} {
+	var positives []map[*Session]struct{}
+	var negatives []TagExpr
+	for _, expr := range e {
+		if not, ok := expr.(notExpr); ok {
+			negatives = append(negatives, not.expr)
+			continue
+		}
+		positives = append(positives, evalTagExpr(expr, h))
+	}
+	var sessions map[*Session]struct{}
+	if len(positives) == 0 {
+		sessions = h.everySession()
+	} else {
+		smallest := 0
+		for i, set := range positives {
+			if len(set) < len(positives[smallest]) {
+				smallest = i
+			}
+		}
+		sessions = positives[smallest]
+		for i, set := range positives {
+			if i == smallest {
+				continue
+			}
+			for session := range sessions {
+				if _, ok := set[session]; !ok {
+					delete(sessions, session)
+				}
+			}
+		}
+	}
+	for _, expr := range negatives {
+		if len(sessions) == 0 {
+			break
+		}
+		for session := range evalTagExpr(expr, h) {
+			delete(sessions, session)
+		}
+	}
+	return sessions
+}
+
+func (e andExpr) String() string {
+	return joinTagExprs(e, " & ")
+}
+
+func (e orExpr) eval(h *haus) map[*Session]struct{} {
+	sessions := make(map[*Session]struct{})
+	for _, expr := range e {
+		for session := range evalTagExpr(expr, h) {
+			sessions[session] = struct{}{}
+		}
+	}
+	return sessions
+}
+
+func (e orExpr) String() string {
+	return joinTagExprs(e, " | ")
+}
+
+func (e notExpr) eval(h *haus) map[*Session]struct{} {
+	return andExpr{e}.eval(h)
+}
+
+func (e notExpr) String() string {
+	return "!" + tagExprString(e.expr)
+}
+
+func joinTagExprs(exprs []TagExpr, separator string) string {
+	parts := make([]string, len(exprs))
+	for i, expr := range exprs {
+		parts[i] = tagExprString(expr)
+	}
+	return "(" + strings.Join(parts, separator) + ")"
+}
+
+// ParseTagExpr parses an expression such as "region:eu & plan:pro & !muted".
+// "&" is intersection, "|" is union, "!" is exclusion and parentheses group, "&" binds tighter than "|".
+// Tags are any characters except whitespace and the operators.
+func ParseTagExpr(query string) (TagExpr, error) {
+	p := &tagExprParser{query: query}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpaces(); p.pos < len(p.query) {
+		return nil, fmt.Errorf("unexpected %q at %d in tag expression %q", p.query[p.pos], p.pos, query)
+	}
+	return expr, nil
+}
+
+type tagExprParser struct {
+	query string
+	pos   int
+}
+
+func (p *tagExprParser) parseOr() (TagExpr, error) {
+	exprs, err := p.parseList(p.parseAnd, '|')
+	if err != nil || len(exprs) == 1 {
+		return firstTagExpr(exprs), err
+	}
+	return orExpr(exprs), nil
+}
+
+func (p *tagExprParser) parseAnd() (TagExpr, error) {
+	exprs, err := p.parseList(p.parseUnary, '&')
+	if err != nil || len(exprs) == 1 {
+		return firstTagExpr(exprs), err
+	}
+	return andExpr(exprs), nil
+}
+
+func (p *tagExprParser) parseList(parse func() (TagExpr, error), operator byte) ([]TagExpr, error) {
+	var exprs []TagExpr
+	for {
+		expr, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if p.skipSpaces(); p.pos >= len(p.query) || p.query[p.pos] != operator {
+			return exprs, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tagExprParser) parseUnary() (TagExpr, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.query) {
+		return nil, fmt.Errorf("unexpected end of tag expression %q", p.query)
+	}
+	switch p.query[p.pos] {
+	case '!':
+		p.pos++
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(expr), nil
+	case '(':
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.skipSpaces(); p.pos >= len(p.query) || p.query[p.pos] != ')' {
+			return nil, fmt.Errorf("missing ')' in tag expression %q", p.query)
+		}
+		p.pos++
+		return expr, nil
+	}
+	start := p.pos
+	for p.pos < len(p.query) && !strings.ContainsRune(" \t\n&|!()", rune(p.query[p.pos])) {
+		p.pos++
+	}
+	if start == p.pos {
+		return nil, fmt.Errorf("unexpected %q at %d in tag expression %q", p.query[p.pos], p.pos, p.query)
+	}
+	return Tag(p.query[start:p.pos]), nil
+}
+
+func (p *tagExprParser) skipSpaces() {
+	for p.pos < len(p.query) && strings.ContainsRune(" \t\n", rune(p.query[p.pos])) {
+		p.pos++
+	}
+}
+
+func firstTagExpr(exprs []TagExpr) TagExpr {
+	if len(exprs) == 0 {
+		return nil
+	}
+	return exprs[0]
+}
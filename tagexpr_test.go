@@ -0,0 +1,79 @@
+package soket
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTagExpr(t *testing.T) {
+	cases := map[string]string{
+		"a":                             "a",
+		"region:eu & plan:pro & !muted": "(region:eu & plan:pro & !muted)",
+		"a | b & c":                     "(a | (b & c))",
+		"(a | b) & !(c | d)":            "((a | b) & !(c | d))",
+		"!!a":                           "!!a",
+	}
+	for query, expected := range cases {
+		expr, err := ParseTagExpr(query)
+		assert.Nil(t, err, query)
+		assert.Equal(t, expected, expr.String(), query)
+	}
+
+	for _, query := range []string{"", "a &", "(a | b", "a b", "a & )", "|"} {
+		_, err := ParseTagExpr(query)
+		assert.NotNil(t, err, query)
+	}
+}
+
+func TestFilterSessionsByTagExpr(t *testing.T) {
+	s := newBroadcastTestSoket()
+	newBroadcastTestSession(s, "eu-pro", 5, "region:eu", "plan:pro")
+	newBroadcastTestSession(s, "eu-pro-muted", 5, "region:eu", "plan:pro", "muted")
+	newBroadcastTestSession(s, "eu-free", 5, "region:eu")
+	newBroadcastTestSession(s, "us-pro", 5, "region:us", "plan:pro")
+
+	ids := func(expr TagExpr) []string {
+		var ids []string
+		for session := range s.haus.filterSessionsByTagExpr(expr) {
+			ids = append(ids, session.GetID())
+		}
+		return ids
+	}
+
+	assert.ElementsMatch(t, []string{"eu-pro"}, ids(And(Tag("region:eu"), Tag("plan:pro"), Not(Tag("muted")))))
+	assert.ElementsMatch(t, []string{"eu-free", "us-pro"}, ids(Or(Tag("region:us"), And(Tag("region:eu"), Not(Tag("plan:pro"))))))
+	assert.ElementsMatch(t, []string{"eu-free"}, ids(Not(Tag("plan:pro"))))
+	assert.Empty(t, ids(Tag("tag-not-exists")))
+
+	assert.Equal(t, 3, s.CountTagExpr(Tag("plan:pro")))
+	assert.Equal(t, 0, s.CountTagExpr(nil))
+}
+
+func TestTagExprNilOperands(t *testing.T) {
+	s := newBroadcastTestSoket()
+	newBroadcastTestSession(s, "pro", 5, "plan:pro")
+	newBroadcastTestSession(s, "free", 5, "plan:free")
+
+	assert.Equal(t, 0, s.CountTagExpr(And(Tag("plan:pro"), nil)))
+	assert.Equal(t, 1, s.CountTagExpr(Or(Tag("plan:pro"), nil)))
+	assert.Equal(t, 2, s.CountTagExpr(Not(nil)))
+	assert.Equal(t, 1, s.CountTagExpr(And(Tag("plan:pro"), Not(nil))))
+	assert.Equal(t, "(plan:pro | ())", Or(Tag("plan:pro"), nil).String())
+	assert.Equal(t, "!()", Not(nil).String())
+}
+
+func TestBroadcastBuilderToTagQuery(t *testing.T) {
+	s := newBroadcastTestSoket()
+	target := newBroadcastTestSession(s, "target", 5, "a", "b")
+	newBroadcastTestSession(s, "muted", 5, "a", "b", "muted")
+
+	report, err := s.Broadcast([]byte("msg")).ToTagQuery("a & b & !muted").Send(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Targeted: 1, Enqueued: 1}, report)
+	assert.Len(t, target.messageQueue, 1)
+
+	_, err = s.Broadcast([]byte("msg")).ToTagQuery("a &").Send(context.Background())
+	assert.NotNil(t, err)
+}
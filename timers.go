@@ -0,0 +1,120 @@
+package soket
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startTimers schedules the pings, the heartbeats, the pong deadline and the idle timeout of the session on the timing wheel.
+// The first ping is at a random point of PingPeriod so sessions connecting together do not ping together.
+func (s *Session) startTimers() {
+	w := s.soket.wheel
+	if w == nil {
+		return
+	}
+	conf := s.soket.Config
+	now := s.soket.now().UnixNano()
+	atomic.StoreInt64(&s.lastPong, now)
+	atomic.StoreInt64(&s.lastActivity, now)
+	s.timersMutex.Lock()
+	defer s.timersMutex.Unlock()
+	if conf.PingPeriod > 0 {
+		s.pingTimer = newTimer(s.ping)
+		w.reset(s.pingTimer, jitter(conf.PingPeriod))
+	}
+	if conf.PongPeriod > 0 {
+		s.pongTimer = newTimer(func() {
+			s.expire(&s.pongTimer, &s.lastPong, conf.PongPeriod, ErrPongTimeout)
+		})
+		w.reset(s.pongTimer, conf.PongPeriod)
+	}
+	if conf.IdleTimeout > 0 {
+		s.idleTimer = newTimer(func() {
+			s.expire(&s.idleTimer, &s.lastActivity, conf.IdleTimeout, ErrIdleTimeout)
+		})
+		w.reset(s.idleTimer, conf.IdleTimeout)
+	}
+	if conf.HeartbeatPeriod > 0 {
+		s.heartbeatTimer = newTimer(s.heartbeat)
+		w.reset(s.heartbeatTimer, jitter(conf.HeartbeatPeriod))
+	}
+}
+
+func (s *Session) stopTimers() {
+	w := s.soket.wheel
+	if w == nil {
+		return
+	}
+	s.timersMutex.Lock()
+	defer s.timersMutex.Unlock()
+	w.stop(s.pingTimer)
+	w.stop(s.pongTimer)
+	w.stop(s.idleTimer)
+	w.stop(s.heartbeatTimer)
+	s.pingTimer, s.pongTimer, s.idleTimer, s.heartbeatTimer = nil, nil, nil, nil
+}
+
+// ping queues a ping ahead of the other messages and schedules the next one.
+func (s *Session) ping() {
+	if !s.rearm(&s.pingTimer, s.soket.Config.PingPeriod) {
+		return
+	}
+	s.queueTimed(&packet{eType: websocket.PingMessage, priority: PriorityControl})
+}
+
+// queueTimed queues a packet of the timers. A packet that cannot be queued is reported in a goroutine,
+// so the handlers do not hold up the wheel.
+func (s *Session) queueTimed(pck *packet) {
+	if err := s.enqueue(pck); err != nil {
+		go s.undelivered(pck, err)
+		return
+	}
+	if s.onDemand {
+		s.wake()
+	}
+}
+
+// expire closes the socket if nothing happened for the period since last, otherwise checks again when it would be due.
+func (s *Session) expire(t **timer, last *int64, period time.Duration, reason error) {
+	quiet := s.soket.now().Sub(time.Unix(0, atomic.LoadInt64(last)))
+	if quiet < period {
+		s.rearm(t, period-quiet)
+		return
+	}
+	s.timersMutex.Lock()
+	stopped := *t == nil
+	s.timersMutex.Unlock()
+	if stopped {
+		return
+	}
+	go s.timeout(reason)
+}
+
+// timeout reports why the session timed out and closes its socket. The timers call it in a goroutine of its own,
+// so the handlers and the socket do not hold up the wheel.
+func (s *Session) timeout(reason error) {
+	s.soket.handlers.errorHandler(s, reason)
+	if err := s.socketAdapter.Close(); err != nil {
+		s.soket.handlers.errorHandler(s, err)
+	}
+}
+
+// rearm schedules the timer again unless the timers were stopped meanwhile.
+func (s *Session) rearm(t **timer, d time.Duration) bool {
+	s.timersMutex.Lock()
+	defer s.timersMutex.Unlock()
+	if *t == nil {
+		return false
+	}
+	s.soket.wheel.reset(*t, d)
+	return true
+}
+
+func (s *Soket) now() time.Time {
+	if s.wheel != nil {
+		return s.wheel.clock.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,98 @@
+package soket
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// TopicSeparator splits a topic into levels, e.g. "prices.eq.AAPL".
+	TopicSeparator = "."
+
+	// TopicWildcardOne matches exactly one level, e.g. "prices.*.AAPL".
+	TopicWildcardOne = "*"
+
+	// TopicWildcardAll matches the remaining levels, including none, e.g. "prices.#". It must be the last level.
+	TopicWildcardAll = "#"
+)
+
+// topicNode is a trie of subscribed tags split by TopicSeparator.
+// Publishing to a topic walks only the branches that can match, instead of checking every subscription.
+type topicNode struct {
+	children map[string]*topicNode
+	sessions map[*Session]struct{}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+		sessions: make(map[*Session]struct{}),
+	}
+}
+
+func splitTopic(topic string) []string {
+	return strings.Split(topic, TopicSeparator)
+}
+
+// validateTopic checks that the wildcards of a subscribed tag are whole levels and TopicWildcardAll is the last one.
+func validateTopic(topic string) error {
+	levels := splitTopic(topic)
+	for i, level := range levels {
+		switch {
+		case level == TopicWildcardAll && i < len(levels)-1:
+			return fmt.Errorf("%w: %s is not the last level | Topic: %s", ErrInvalidTopic, TopicWildcardAll, topic)
+		case level != TopicWildcardOne && level != TopicWildcardAll && strings.ContainsAny(level, TopicWildcardOne+TopicWildcardAll):
+			return fmt.Errorf("%w: wildcard in level %s | Topic: %s", ErrInvalidTopic, level, topic)
+		}
+	}
+	return nil
+}
+
+func (n *topicNode) insert(levels []string, session *Session) {
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			child = newTopicNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.sessions[session] = struct{}{}
+}
+
+// remove deletes the session and prunes the branches left empty.
+func (n *topicNode) remove(levels []string, session *Session) {
+	if len(levels) == 0 {
+		delete(n.sessions, session)
+		return
+	}
+	child, ok := n.children[levels[0]]
+	if !ok {
+		return
+	}
+	child.remove(levels[1:], session)
+	if len(child.sessions) == 0 && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+}
+
+// match collects the sessions whose subscription matches the published topic levels.
+func (n *topicNode) match(levels []string, sessions map[*Session]struct{}) {
+	if all, ok := n.children[TopicWildcardAll]; ok {
+		for session := range all.sessions {
+			sessions[session] = struct{}{}
+		}
+	}
+	if len(levels) == 0 {
+		for session := range n.sessions {
+			sessions[session] = struct{}{}
+		}
+		return
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], sessions)
+	}
+	if one, ok := n.children[TopicWildcardOne]; ok {
+		one.match(levels[1:], sessions)
+	}
+}
@@ -0,0 +1,79 @@
+package soket
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicMatch(t *testing.T) {
+	root := newTopicNode()
+	subscriptions := map[string]*Session{
+		"prices.eq.AAPL": {id: "exact"},
+		"prices.eq.*":    {id: "one"},
+		"prices.#":       {id: "all"},
+		"*.eq.*":         {id: "two"},
+		"prices.fx.*":    {id: "fx"},
+	}
+	for topic, session := range subscriptions {
+		root.insert(splitTopic(topic), session)
+	}
+
+	ids := func(topic string) []string {
+		sessions := make(map[*Session]struct{})
+		root.match(splitTopic(topic), sessions)
+		var ids []string
+		for session := range sessions {
+			ids = append(ids, session.GetID())
+		}
+		return ids
+	}
+
+	assert.ElementsMatch(t, []string{"exact", "one", "all", "two"}, ids("prices.eq.AAPL"))
+	assert.ElementsMatch(t, []string{"one", "all", "two"}, ids("prices.eq.MSFT"))
+	assert.ElementsMatch(t, []string{"all", "fx"}, ids("prices.fx.EURUSD"))
+	assert.ElementsMatch(t, []string{"all"}, ids("prices"))
+	assert.ElementsMatch(t, []string{"all"}, ids("prices.eq.AAPL.bid"))
+	assert.ElementsMatch(t, []string{"two"}, ids("news.eq.AAPL"))
+	assert.Empty(t, ids("news.fx.EURUSD"))
+
+	root.remove(splitTopic("prices.fx.*"), subscriptions["prices.fx.*"])
+	_, ok := root.children["prices"].children["fx"]
+	assert.False(t, ok)
+}
+
+func TestSubscribeUnsubscribe(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 5, "lobby")
+
+	assert.Nil(t, s.Subscribe(session, "prices.eq.*"))
+	assert.Len(t, s.haus.filterSessionsByTopic("prices.eq.AAPL"), 1)
+	assert.Len(t, s.haus.filterSessionsByTag("prices.eq.*"), 1)
+	assert.Len(t, s.haus.filterSessionsByTopic("lobby"), 1)
+
+	report, err := s.Broadcast([]byte("msg")).ToTopics("prices.eq.AAPL").Send(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, DeliveryReport{Targeted: 1, Enqueued: 1}, report)
+
+	s.Unsubscribe(session, "prices.eq.*")
+	assert.Len(t, s.haus.filterSessionsByTopic("prices.eq.AAPL"), 0)
+	assert.Len(t, s.haus.filterSessionsByTag("prices.eq.*"), 0)
+
+	s.haus.unregisterSession(session)
+	assert.Len(t, s.haus.filterSessionsByTopic("lobby"), 0)
+	assert.Empty(t, session.tags)
+}
+
+func TestSubscribeRejectsMisplacedWildcards(t *testing.T) {
+	s := newBroadcastTestSoket()
+	session := newBroadcastTestSession(s, "1", 5)
+
+	for _, topic := range []string{"prices.#.eq", "#.eq", "prices.eq*", "prices.#eq", "prices.a#"} {
+		assert.ErrorIs(t, s.Subscribe(session, "lobby", topic), ErrInvalidTopic, topic)
+	}
+	assert.Empty(t, session.tags)
+
+	assert.Nil(t, s.Subscribe(session, "#", "*.eq.*", "prices.#"))
+	assert.Len(t, session.tags, 3)
+}
@@ -0,0 +1,517 @@
+package soket
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transfer is a file uploaded by a client with the transfer protocol, see HandleTransfer.
+type Transfer struct {
+	ID     string
+	Name   string
+	Size   int64
+	SHA256 string
+	// Path is the temporary file holding the data, it is removed once the handler returns unless the handler moved it.
+	Path string
+	// Reader reads the data from the start, it is valid until the handler returns.
+	Reader io.Reader
+}
+
+// TransferHandler is given every upload whose checksum matched, the error is sent to the client.
+type TransferHandler func(*Session, *Transfer) error
+
+// transferFrame is a message of the transfer protocol, sent as {"transfer":{...}}.
+//
+//	begin  announces a file with its id, name and size, the receiver answers with an ack of the offset to start at
+//	chunk  carries the data at the offset, every chunk is acked with the offset received so far
+//	end    carries the SHA-256 of the whole file, the receiver answers with done or error
+type transferFrame struct {
+	Op     string `json:"op"`
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Offset int64  `json:"offset"`
+	Window int    `json:"window,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type transferMessage struct {
+	Transfer *transferFrame `json:"transfer"`
+}
+
+const (
+	transferBegin = "begin"
+	transferChunk = "chunk"
+	transferEnd   = "end"
+	transferAck   = "ack"
+	transferDone  = "done"
+	transferError = "error"
+)
+
+// transfers keeps the uploads in progress, they outlive their session so they can be resumed
+// by another session of the same user with the same transfer id. The uploads of a session without
+// a user id belong to that session alone.
+type transfers struct {
+	mutex   sync.Mutex
+	uploads map[string]*upload
+	// active counts the uploads in progress by their scope, see uploadScope
+	active map[string]int
+}
+
+type upload struct {
+	mutex    sync.Mutex
+	key      string
+	scope    string
+	owner    *Session
+	name     string
+	size     int64
+	file     *os.File
+	received int64
+	hash     hash.Hash
+	expiry   *timer
+	gone     bool
+}
+
+func newTransfers() *transfers {
+	return &transfers{uploads: make(map[string]*upload), active: make(map[string]int)}
+}
+
+// uploadScope is the user of the session, or the session itself when it has no user id,
+// so anonymous sessions never see the uploads of each other.
+func uploadScope(session *Session) string {
+	if userID := session.GetUserID(); userID != "" {
+		return "user\x00" + userID
+	}
+	return "session\x00" + session.GetID()
+}
+
+func uploadKey(session *Session, id string) string {
+	return uploadScope(session) + "\x00" + id
+}
+
+// handleTransfer handles a transfer protocol frame, returns false if the message is not one.
+func (s *Soket) handleTransfer(session *Session, message []byte) bool {
+	if !bytes.Contains(message, []byte(`"transfer"`)) {
+		return false
+	}
+	var request transferMessage
+	if err := json.Unmarshal(message, &request); err != nil || request.Transfer == nil {
+		return false
+	}
+	frame := request.Transfer
+	switch frame.Op {
+	case transferBegin:
+		s.beginUpload(session, frame)
+	case transferChunk:
+		s.receiveChunk(session, frame)
+	case transferEnd:
+		s.endUpload(session, frame)
+	case transferAck, transferDone, transferError:
+		session.answerDownload(frame)
+	default:
+		s.sendTransfer(session, &transferFrame{Op: transferError, ID: frame.ID, Error: "unknown op " + frame.Op})
+	}
+	return true
+}
+
+// beginUpload starts an upload or resumes the one with the same id, the ack tells the client where to continue.
+func (s *Soket) beginUpload(session *Session, frame *transferFrame) {
+	conf := s.Config
+	switch {
+	case s.handlers.transferHandler == nil:
+		s.failTransfer(session, frame.ID, errors.New("transfers are not handled"))
+		return
+	case frame.Size < 0 || frame.Size > conf.TransferMaxSize:
+		s.failTransfer(session, frame.ID, ErrTransferTooLarge)
+		return
+	}
+	scope := uploadScope(session)
+	key := uploadKey(session, frame.ID)
+	s.transfers.mutex.Lock()
+	u, ok := s.transfers.uploads[key]
+	if !ok {
+		if s.transfers.active[scope] >= conf.MaxUploads {
+			s.transfers.mutex.Unlock()
+			s.failTransfer(session, frame.ID, ErrTransferLimit)
+			return
+		}
+		u = &upload{key: key, scope: scope}
+		// the wheel must not wait for an upload being written
+		u.expiry = newTimer(func() { go s.dropUpload(u) })
+		s.transfers.uploads[key] = u
+		s.transfers.active[scope]++
+	}
+	s.transfers.mutex.Unlock()
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.gone {
+		s.failTransfer(session, frame.ID, ErrTransferUnknown)
+		return
+	}
+	// another session of the user takes the upload over once the session uploading it is closed
+	if u.owner != nil && u.owner != session && !u.owner.isClosed() {
+		s.failTransfer(session, frame.ID, ErrTransferInUse)
+		return
+	}
+	u.owner = session
+	if u.file == nil || u.size != frame.Size || u.name != frame.Name {
+		if err := u.restart(frame); err != nil {
+			s.handlers.errorHandler(session, err)
+			s.forgetUpload(u)
+			s.failTransfer(session, frame.ID, err)
+			return
+		}
+	}
+	s.keepUpload(u)
+	s.sendTransfer(session, &transferFrame{Op: transferAck, ID: frame.ID, Offset: u.received, Window: conf.TransferWindow})
+}
+
+// restart empties the upload for a new file.
+func (u *upload) restart(frame *transferFrame) error {
+	u.closeFile()
+	file, err := os.CreateTemp("", "soket-transfer-*")
+	if err != nil {
+		return err
+	}
+	u.file = file
+	u.name = frame.Name
+	u.size = frame.Size
+	u.received = 0
+	u.hash = sha256.New()
+	return nil
+}
+
+// receiveChunk appends the chunk if it starts where the upload stands, otherwise the ack tells the client where it does.
+func (s *Soket) receiveChunk(session *Session, frame *transferFrame) {
+	u := s.findUpload(session, frame.ID)
+	if u == nil {
+		s.failTransfer(session, frame.ID, ErrTransferUnknown)
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.gone {
+		s.failTransfer(session, frame.ID, ErrTransferUnknown)
+		return
+	}
+	if len(frame.Data) > s.Config.TransferChunkSize {
+		s.failTransfer(session, frame.ID, ErrTransferTooLarge)
+		return
+	}
+	if frame.Offset == u.received {
+		if u.received+int64(len(frame.Data)) > u.size {
+			s.failTransfer(session, frame.ID, ErrTransferTooLarge)
+			return
+		}
+		if _, err := u.file.Write(frame.Data); err != nil {
+			s.handlers.errorHandler(session, err)
+			s.failTransfer(session, frame.ID, err)
+			return
+		}
+		u.hash.Write(frame.Data)
+		u.received += int64(len(frame.Data))
+	}
+	s.keepUpload(u)
+	s.sendTransfer(session, &transferFrame{Op: transferAck, ID: frame.ID, Offset: u.received})
+}
+
+// endUpload checks the upload against the checksum of the client and hands it to the transfer handler
+// in a goroutine of its own, so a slow handler does not hold up the reads of the session.
+func (s *Soket) endUpload(session *Session, frame *transferFrame) {
+	u := s.findUpload(session, frame.ID)
+	if u == nil {
+		s.failTransfer(session, frame.ID, ErrTransferUnknown)
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.gone {
+		s.failTransfer(session, frame.ID, ErrTransferUnknown)
+		return
+	}
+	defer s.forgetUpload(u)
+	sum := hex.EncodeToString(u.hash.Sum(nil))
+	if u.received != u.size || !strings.EqualFold(sum, frame.SHA256) {
+		s.failTransfer(session, frame.ID, ErrTransferChecksum)
+		return
+	}
+	// the file is the handler's now, forgetUpload leaves it alone
+	file := u.file
+	u.file = nil
+	go s.completeUpload(session, file, &Transfer{
+		ID:     frame.ID,
+		Name:   u.name,
+		Size:   u.size,
+		SHA256: sum,
+		Path:   file.Name(),
+		Reader: file,
+	})
+}
+
+// completeUpload runs the transfer handler, removes the file and tells the client the outcome.
+func (s *Soket) completeUpload(session *Session, file *os.File, transfer *Transfer) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		s.handlers.errorHandler(session, err)
+	} else {
+		err = s.handlers.transferHandler(session, transfer)
+	}
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+	if err != nil {
+		s.failTransfer(session, transfer.ID, err)
+		return
+	}
+	s.sendTransfer(session, &transferFrame{Op: transferDone, ID: transfer.ID, Offset: transfer.Size})
+}
+
+// findUpload returns the upload the session began or resumed, nil for the uploads of other sessions.
+func (s *Soket) findUpload(session *Session, id string) *upload {
+	s.transfers.mutex.Lock()
+	u := s.transfers.uploads[uploadKey(session, id)]
+	s.transfers.mutex.Unlock()
+	if u == nil {
+		return nil
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.owner != session {
+		return nil
+	}
+	return u
+}
+
+// keepUpload postpones the removal of an unfinished upload for config.WithTransfers' ttl.
+func (s *Soket) keepUpload(u *upload) {
+	if s.wheel != nil {
+		s.wheel.reset(u.expiry, s.Config.TransferTTL)
+	}
+}
+
+// dropUpload removes an upload that was not resumed in time.
+func (s *Soket) dropUpload(u *upload) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if !u.gone {
+		s.forgetUpload(u)
+	}
+}
+
+// forgetUpload removes the upload and its file, the caller holds its lock.
+func (s *Soket) forgetUpload(u *upload) {
+	u.gone = true
+	if s.wheel != nil {
+		s.wheel.stop(u.expiry)
+	}
+	s.transfers.mutex.Lock()
+	if s.transfers.uploads[u.key] == u {
+		delete(s.transfers.uploads, u.key)
+		if s.transfers.active[u.scope]--; s.transfers.active[u.scope] == 0 {
+			delete(s.transfers.active, u.scope)
+		}
+	}
+	s.transfers.mutex.Unlock()
+	u.closeFile()
+}
+
+func (u *upload) closeFile() {
+	if u.file == nil {
+		return
+	}
+	_ = u.file.Close()
+	_ = os.Remove(u.file.Name())
+	u.file = nil
+}
+
+func (s *Soket) failTransfer(session *Session, id string, err error) {
+	s.sendTransfer(session, &transferFrame{Op: transferError, ID: id, Error: err.Error()})
+}
+
+func (s *Soket) sendTransfer(session *Session, frame *transferFrame) error {
+	payload, err := json.Marshal(transferMessage{Transfer: frame})
+	if err != nil {
+		return err
+	}
+	return session.writeMessageToPipe(&packet{eType: websocket.TextMessage, message: payload})
+}
+
+// download is a file sent with SendFile, the answers of the client wake it up.
+type download struct {
+	mutex    sync.Mutex
+	started  bool
+	acked    int64
+	finished bool
+	err      error
+	signal   chan struct{}
+}
+
+// SendFile sends the file to the client with the transfer protocol and returns once the client confirmed
+// the checksum. If the client answers the begin frame with a later offset, e.g. it kept a part of the file from
+// a connection that broke, only the rest is sent. At most config.WithTransfers' window of chunks are not acked at any time.
+func (s *Session) SendFile(ctx context.Context, id string, name string, r io.ReadSeeker) error {
+	conf := s.soket.Config
+	if conf.TransferChunkSize <= 0 {
+		return errors.New("transfers are not configured")
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	d, err := s.startDownload(id)
+	if err != nil {
+		return err
+	}
+	defer s.endDownload(id)
+	if err := s.soket.sendTransfer(s, &transferFrame{Op: transferBegin, ID: id, Name: name, Size: size, Window: conf.TransferWindow}); err != nil {
+		return err
+	}
+	if err := d.wait(ctx, func() bool { return d.started }); err != nil {
+		return err
+	}
+	offset := d.acked
+	if offset < 0 || offset > size {
+		offset = 0
+	}
+	// the checksum covers the part the client already has
+	hash := sha256.New()
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(hash, r, offset); err != nil {
+		return err
+	}
+	chunk := make([]byte, conf.TransferChunkSize)
+	window := int64(conf.TransferWindow * conf.TransferChunkSize)
+	for sent := offset; sent < size; {
+		if err := d.wait(ctx, func() bool { return sent-d.acked < window }); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(r, chunk[:min64(int64(len(chunk)), size-sent)])
+		if err != nil {
+			return err
+		}
+		hash.Write(chunk[:n])
+		if err := s.soket.sendTransfer(s, &transferFrame{Op: transferChunk, ID: id, Offset: sent, Data: chunk[:n]}); err != nil {
+			return err
+		}
+		sent += int64(n)
+	}
+	if err := s.soket.sendTransfer(s, &transferFrame{Op: transferEnd, ID: id, Offset: size, SHA256: hex.EncodeToString(hash.Sum(nil))}); err != nil {
+		return err
+	}
+	if err := d.wait(ctx, func() bool { return d.finished }); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Session) startDownload(id string) (*download, error) {
+	s.downloadsMutex.Lock()
+	defer s.downloadsMutex.Unlock()
+	if _, ok := s.downloads[id]; ok {
+		return nil, fmt.Errorf("transfer %s is already being sent", id)
+	}
+	if s.downloads == nil {
+		s.downloads = make(map[string]*download)
+	}
+	d := &download{signal: make(chan struct{}, 1)}
+	s.downloads[id] = d
+	return d, nil
+}
+
+func (s *Session) endDownload(id string) {
+	s.downloadsMutex.Lock()
+	delete(s.downloads, id)
+	s.downloadsMutex.Unlock()
+}
+
+// answerDownload passes an ack, done or error frame of the client to the download it belongs to.
+func (s *Session) answerDownload(frame *transferFrame) {
+	s.downloadsMutex.Lock()
+	d, ok := s.downloads[frame.ID]
+	s.downloadsMutex.Unlock()
+	if !ok {
+		return
+	}
+	d.mutex.Lock()
+	switch frame.Op {
+	case transferAck:
+		d.started = true
+		d.acked = frame.Offset
+	case transferDone:
+		d.finished = true
+	case transferError:
+		d.finish(fmt.Errorf("%w: %s", ErrTransferFailed, frame.Error))
+	}
+	d.mutex.Unlock()
+	d.notify()
+}
+
+// failDownloads ends the downloads of a closing session.
+func (s *Session) failDownloads() {
+	s.downloadsMutex.Lock()
+	defer s.downloadsMutex.Unlock()
+	for _, d := range s.downloads {
+		d.mutex.Lock()
+		d.finish(ErrSessionClosed)
+		d.mutex.Unlock()
+		d.notify()
+	}
+}
+
+// finish ends the download with the error, the caller holds its lock.
+func (d *download) finish(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.finished = true
+}
+
+func (d *download) notify() {
+	select {
+	case d.signal <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ready holds, the download failed or the context is done. ready is called with the lock held.
+func (d *download) wait(ctx context.Context, ready func() bool) error {
+	for {
+		d.mutex.Lock()
+		err, ok := d.err, ready()
+		d.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-d.signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,292 @@
+package soket
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTransferTestSoket(handler TransferHandler) *Soket {
+	s := New(config.WithMaxMessageSize(4096), config.WithTransfers(1000, 10, 2, time.Minute, 2)).(*Soket)
+	s.HandleTransfer(handler)
+	return s
+}
+
+func writeTransfer(t *testing.T, conn *websocket.Conn, frame transferFrame) {
+	payload, _ := json.Marshal(transferMessage{Transfer: &frame})
+	assert.Nil(t, conn.WriteMessage(websocket.TextMessage, payload))
+}
+
+func readTransfer(t *testing.T, conn *websocket.Conn) transferFrame {
+	var message transferMessage
+	assert.Nil(t, conn.ReadJSON(&message))
+	if message.Transfer == nil {
+		t.Fatal("not a transfer frame")
+	}
+	return *message.Transfer
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadData sends the data from the offset acked for begin, in chunks of 10 bytes.
+func uploadData(t *testing.T, conn *websocket.Conn, id string, data []byte) transferFrame {
+	writeTransfer(t, conn, transferFrame{Op: transferBegin, ID: id, Name: "file.txt", Size: int64(len(data))})
+	ack := readTransfer(t, conn)
+	assert.Equal(t, transferAck, ack.Op)
+	assert.Equal(t, 2, ack.Window)
+	for offset := ack.Offset; offset < int64(len(data)); offset += 10 {
+		end := offset + 10
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		writeTransfer(t, conn, transferFrame{Op: transferChunk, ID: id, Offset: offset, Data: data[offset:end]})
+		assert.Equal(t, transferFrame{Op: transferAck, ID: id, Offset: end}, readTransfer(t, conn))
+	}
+	writeTransfer(t, conn, transferFrame{Op: transferEnd, ID: id, SHA256: checksum(data)})
+	return readTransfer(t, conn)
+}
+
+func TestTransferUpload(t *testing.T) {
+	data := []byte("the content of an attachment")
+	var path string
+	s := newTransferTestSoket(func(session *Session, transfer *Transfer) error {
+		received, err := io.ReadAll(transfer.Reader)
+		assert.Nil(t, err)
+		assert.Equal(t, data, received)
+		assert.Equal(t, "file.txt", transfer.Name)
+		assert.Equal(t, checksum(data), transfer.SHA256)
+		path = transfer.Path
+		_, err = os.Stat(path)
+		assert.Nil(t, err)
+		return nil
+	})
+	defer s.Shutdown()
+	conn, _, done := dialTestSoket(t, s)
+	defer done()
+
+	assert.Equal(t, transferFrame{Op: transferDone, ID: "a", Offset: int64(len(data))}, uploadData(t, conn, "a", data))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTransferResume(t *testing.T) {
+	data := []byte("resumed after the connection broke")
+	var received []byte
+	s := newTransferTestSoket(func(session *Session, transfer *Transfer) error {
+		received, _ = io.ReadAll(transfer.Reader)
+		return nil
+	})
+	defer s.Shutdown()
+
+	conn, first, done := dialTestSoketAs(t, s, "user")
+	writeTransfer(t, conn, transferFrame{Op: transferBegin, ID: "b", Name: "file.txt", Size: int64(len(data))})
+	assert.Equal(t, int64(0), readTransfer(t, conn).Offset)
+	writeTransfer(t, conn, transferFrame{Op: transferChunk, ID: "b", Offset: 0, Data: data[:10]})
+	assert.Equal(t, int64(10), readTransfer(t, conn).Offset)
+	// a chunk at the wrong offset is not written, the ack tells where to continue
+	writeTransfer(t, conn, transferFrame{Op: transferChunk, ID: "b", Offset: 20, Data: data[20:30]})
+	assert.Equal(t, int64(10), readTransfer(t, conn).Offset)
+
+	// another session of the user cannot take over while the first one is connected
+	other, _, doneOther := dialTestSoketAs(t, s, "user")
+	writeTransfer(t, other, transferFrame{Op: transferBegin, ID: "b", Name: "file.txt", Size: int64(len(data))})
+	assert.Equal(t, ErrTransferInUse.Error(), readTransfer(t, other).Error)
+	doneOther()
+
+	done()
+	assert.Eventually(t, first.isClosed, 5*time.Second, time.Millisecond)
+	conn, _, done = dialTestSoketAs(t, s, "user")
+	defer done()
+	assert.Equal(t, transferDone, uploadData(t, conn, "b", data).Op)
+	assert.Equal(t, data, received)
+}
+
+func TestAnonymousUploadsAreNotShared(t *testing.T) {
+	s := newTransferTestSoket(func(*Session, *Transfer) error { return nil })
+	defer s.Shutdown()
+	conn, _, done := dialTestSoket(t, s)
+	defer done()
+	other, _, doneOther := dialTestSoket(t, s)
+	defer doneOther()
+
+	writeTransfer(t, conn, transferFrame{Op: transferBegin, ID: "d", Name: "file.txt", Size: 20})
+	readTransfer(t, conn)
+	writeTransfer(t, conn, transferFrame{Op: transferChunk, ID: "d", Data: []byte("0123456789")})
+	assert.Equal(t, int64(10), readTransfer(t, conn).Offset)
+
+	// the same id names a new upload of the other session
+	writeTransfer(t, other, transferFrame{Op: transferBegin, ID: "d", Name: "file.txt", Size: 20})
+	assert.Equal(t, int64(0), readTransfer(t, other).Offset)
+}
+
+func TestTransferRefused(t *testing.T) {
+	s := newTransferTestSoket(func(*Session, *Transfer) error {
+		t.Error("the handler must not be called")
+		return nil
+	})
+	defer s.Shutdown()
+	conn, _, done := dialTestSoket(t, s)
+	defer done()
+
+	writeTransfer(t, conn, transferFrame{Op: transferBegin, ID: "c", Size: 1001})
+	assert.Equal(t, transferFrame{Op: transferError, ID: "c", Error: ErrTransferTooLarge.Error()}, readTransfer(t, conn))
+
+	writeTransfer(t, conn, transferFrame{Op: transferChunk, ID: "c", Data: []byte("x")})
+	assert.Equal(t, ErrTransferUnknown.Error(), readTransfer(t, conn).Error)
+
+	writeTransfer(t, conn, transferFrame{Op: transferBegin, ID: "c", Size: 4})
+	readTransfer(t, conn)
+	writeTransfer(t, conn, transferFrame{Op: transferChunk, ID: "c", Data: []byte("data")})
+	readTransfer(t, conn)
+	writeTransfer(t, conn, transferFrame{Op: transferEnd, ID: "c", SHA256: checksum([]byte("else"))})
+	assert.Equal(t, ErrTransferChecksum.Error(), readTransfer(t, conn).Error)
+}
+
+func TestUnfinishedUploadExpires(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.TransferMaxSize, s.Config.TransferChunkSize, s.Config.TransferTTL, s.Config.MaxUploads = 100, 10, time.Minute, 1
+	s.transfers = newTransfers()
+	var clock *fakeClock
+	s.wheel, clock = newTestWheel()
+	s.handlers.transferHandler = func(*Session, *Transfer) error { return nil }
+	session := newBroadcastTestSession(s, "1", 10)
+
+	begin, _ := json.Marshal(transferMessage{Transfer: &transferFrame{Op: transferBegin, ID: "d", Size: 20}})
+	assert.True(t, s.handleTransfer(session, begin))
+	u := s.findUpload(session, "d")
+	assert.NotNil(t, u)
+	path := u.file.Name()
+
+	advance(session, clock, 61*time.Second)
+	assert.Eventually(t, func() bool { return s.findUpload(session, "d") == nil }, time.Second, time.Millisecond)
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSendFile(t *testing.T) {
+	s := newTransferTestSoket(nil)
+	defer s.Shutdown()
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	data := bytes.Repeat([]byte("downloaded "), 5)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.SendFile(context.Background(), "e", "export.txt", bytes.NewReader(data))
+	}()
+	begin := readTransfer(t, conn)
+	assert.Equal(t, transferFrame{Op: transferBegin, ID: "e", Name: "export.txt", Size: int64(len(data)), Window: 2}, begin)
+	// the client kept the first 15 bytes from an earlier attempt
+	received := append([]byte(nil), data[:15]...)
+	writeTransfer(t, conn, transferFrame{Op: transferAck, ID: "e", Offset: 15})
+	for {
+		frame := readTransfer(t, conn)
+		if frame.Op == transferEnd {
+			assert.Equal(t, checksum(data), frame.SHA256)
+			break
+		}
+		assert.Equal(t, transferChunk, frame.Op)
+		assert.Equal(t, int64(len(received)), frame.Offset)
+		received = append(received, frame.Data...)
+		writeTransfer(t, conn, transferFrame{Op: transferAck, ID: "e", Offset: int64(len(received))})
+	}
+	assert.Equal(t, data, received)
+	writeTransfer(t, conn, transferFrame{Op: transferDone, ID: "e"})
+	assert.Nil(t, <-sent)
+}
+
+func TestSendFileWindow(t *testing.T) {
+	s := newTransferTestSoket(nil)
+	defer s.Shutdown()
+	conn, session, done := dialTestSoket(t, s)
+	defer done()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- session.SendFile(context.Background(), "f", "export.txt", bytes.NewReader(make([]byte, 50)))
+	}()
+	readTransfer(t, conn)
+	writeTransfer(t, conn, transferFrame{Op: transferAck, ID: "f"})
+	// two chunks are sent without an ack, then the sender waits
+	readTransfer(t, conn)
+	readTransfer(t, conn)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := conn.ReadMessage()
+	assert.NotNil(t, err)
+
+	writeTransfer(t, conn, transferFrame{Op: transferError, ID: "f", Error: "disk full"})
+	err = <-sent
+	assert.ErrorIs(t, err, ErrTransferFailed)
+	assert.Contains(t, err.Error(), "disk full")
+}
+
+func TestUploadLimit(t *testing.T) {
+	s := newBroadcastTestSoket()
+	s.Config.TransferMaxSize, s.Config.TransferChunkSize, s.Config.TransferTTL, s.Config.MaxUploads = 100, 10, time.Minute, 1
+	s.transfers = newTransfers()
+	s.handlers.transferHandler = func(*Session, *Transfer) error { return nil }
+	session := newBroadcastTestSession(s, "1", 10)
+	begin := func(id string) transferFrame {
+		message, _ := json.Marshal(transferMessage{Transfer: &transferFrame{Op: transferBegin, ID: id, Size: 20}})
+		assert.True(t, s.handleTransfer(session, message))
+		var answer transferMessage
+		assert.Nil(t, json.Unmarshal((<-session.messageQueue).message, &answer))
+		return *answer.Transfer
+	}
+
+	assert.Equal(t, transferAck, begin("a").Op)
+	assert.Equal(t, ErrTransferLimit.Error(), begin("b").Error)
+	// resuming the upload in progress is not a new one
+	assert.Equal(t, transferAck, begin("a").Op)
+
+	// another session has uploads of its own
+	other := newBroadcastTestSession(s, "2", 10)
+	message, _ := json.Marshal(transferMessage{Transfer: &transferFrame{Op: transferBegin, ID: "b", Size: 20}})
+	assert.True(t, s.handleTransfer(other, message))
+	assert.Contains(t, string((<-other.messageQueue).message), transferAck)
+
+	u := s.findUpload(session, "a")
+	u.mutex.Lock()
+	s.forgetUpload(u)
+	u.mutex.Unlock()
+	assert.Equal(t, transferAck, begin("b").Op)
+}
+
+func TestSlowTransferHandlerDoesNotBlockReads(t *testing.T) {
+	release := make(chan struct{})
+	s := newTransferTestSoket(func(*Session, *Transfer) error {
+		<-release
+		return nil
+	})
+	defer s.Shutdown()
+	conn, _, done := dialTestSoket(t, s)
+	defer done()
+
+	data := []byte("handled slowly")
+	writeTransfer(t, conn, transferFrame{Op: transferBegin, ID: "g", Name: "file.txt", Size: int64(len(data))})
+	readTransfer(t, conn)
+	writeTransfer(t, conn, transferFrame{Op: transferChunk, ID: "g", Data: data[:10]})
+	readTransfer(t, conn)
+	writeTransfer(t, conn, transferFrame{Op: transferChunk, ID: "g", Offset: 10, Data: data[10:]})
+	readTransfer(t, conn)
+	writeTransfer(t, conn, transferFrame{Op: transferEnd, ID: "g", SHA256: checksum(data)})
+
+	// the session reads on while the handler runs
+	writeTransfer(t, conn, transferFrame{Op: transferBegin, ID: "h", Name: "other.txt", Size: 1})
+	assert.Equal(t, transferFrame{Op: transferAck, ID: "h", Window: 2}, readTransfer(t, conn))
+	close(release)
+	assert.Equal(t, transferFrame{Op: transferDone, ID: "g", Offset: int64(len(data))}, readTransfer(t, conn))
+}
@@ -0,0 +1,190 @@
+package soket
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/soket/config"
+)
+
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 3
+
+	// DefaultTimerResolution is the tick of the timing wheel, see config.WithTimerResolution.
+	DefaultTimerResolution = 100 * time.Millisecond
+)
+
+// wheel is a hierarchical timing wheel shared by every session for pings, pong deadlines and idle timeouts,
+// so thousands of sessions cost one runtime timer. Level 0 has a slot for each tick, every higher level a slot
+// for a whole revolution of the level below, whose timers are moved down when its turn comes.
+type wheel struct {
+	mutex   sync.Mutex
+	clock   config.Clock
+	tick    time.Duration
+	start   time.Time
+	current uint64
+	levels  [wheelLevels][wheelSlots]map[*timer]struct{}
+}
+
+// timer runs f once its deadline, counted in ticks, has passed.
+type timer struct {
+	deadline uint64
+	slot     map[*timer]struct{}
+	f        func()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+func newWheel(conf *config.Config) *wheel {
+	clock := conf.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	tick := conf.TimerResolution
+	if tick <= 0 {
+		tick = DefaultTimerResolution
+	}
+	return &wheel{
+		clock: clock,
+		tick:  tick,
+		start: clock.Now(),
+	}
+}
+
+// run advances the wheel on every tick of the clock until done is closed.
+func (w *wheel) run(done chan struct{}) {
+	ticks, stop := w.clock.Tick(w.tick)
+	defer stop()
+	for {
+		select {
+		case <-ticks:
+			w.advance(w.clock.Now())
+		case <-done:
+			return
+		}
+	}
+}
+
+// newTimer returns a timer running f from the goroutine of the wheel once it is reset. f must not block.
+func newTimer(f func()) *timer {
+	return &timer{f: f}
+}
+
+// reset schedules the timer d from now, it may be called from its own f to repeat it.
+func (w *wheel) reset(t *timer, d time.Duration) {
+	w.mutex.Lock()
+	w.unlink(t)
+	deadline := w.ticks(w.clock.Now().Add(d))
+	if deadline <= w.current {
+		deadline = w.current + 1
+	}
+	w.place(t, deadline)
+	w.mutex.Unlock()
+}
+
+// stop cancels the timer, it is safe to stop a timer twice or after it ran.
+func (w *wheel) stop(t *timer) {
+	if t == nil {
+		return
+	}
+	w.mutex.Lock()
+	w.unlink(t)
+	w.mutex.Unlock()
+}
+
+// advance runs every timer due until now.
+func (w *wheel) advance(now time.Time) {
+	var due []*timer
+	w.mutex.Lock()
+	target := uint64(0)
+	if elapsed := now.Sub(w.start); elapsed > 0 {
+		target = uint64(elapsed / w.tick)
+	}
+	for w.current < target {
+		w.current++
+		// move the timers of the higher levels down, the highest first so they can land in the slot cascaded next
+		for level := wheelLevels - 1; level > 0; level-- {
+			if w.current&(1<<(wheelBits*level)-1) == 0 {
+				w.cascade(level, int(w.current>>(wheelBits*level))&wheelMask)
+			}
+		}
+		slot := w.levels[0][w.current&wheelMask]
+		for t := range slot {
+			w.unlink(t)
+			if t.deadline <= w.current {
+				due = append(due, t)
+			} else {
+				w.place(t, t.deadline)
+			}
+		}
+	}
+	w.mutex.Unlock()
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (w *wheel) cascade(level int, index int) {
+	for t := range w.levels[level][index] {
+		w.unlink(t)
+		w.place(t, t.deadline)
+	}
+}
+
+// place puts the timer in the lowest level that reaches its deadline, timers beyond the last level
+// wait in its farthest slot and are placed again when it cascades.
+func (w *wheel) place(t *timer, deadline uint64) {
+	t.deadline = deadline
+	level, index := wheelLevels-1, int((w.current>>(wheelBits*(wheelLevels-1)))+wheelMask)&wheelMask
+	for l := 0; l < wheelLevels; l++ {
+		shift := uint(wheelBits * l)
+		if deadline>>shift-w.current>>shift < wheelSlots {
+			level, index = l, int(deadline>>shift)&wheelMask
+			break
+		}
+	}
+	slot := w.levels[level][index]
+	if slot == nil {
+		slot = make(map[*timer]struct{})
+		w.levels[level][index] = slot
+	}
+	slot[t] = struct{}{}
+	t.slot = slot
+}
+
+func (w *wheel) unlink(t *timer) {
+	if t.slot != nil {
+		delete(t.slot, t)
+		t.slot = nil
+	}
+}
+
+// ticks rounds the time up to the tick it is due at.
+func (w *wheel) ticks(at time.Time) uint64 {
+	elapsed := at.Sub(w.start)
+	if elapsed <= 0 {
+		return 0
+	}
+	return uint64((elapsed + w.tick - 1) / w.tick)
+}
+
+// jitter returns a random duration in (0, d], pings of sessions connecting together are spread over the period.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
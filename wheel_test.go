@@ -0,0 +1,191 @@
+package soket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	return nil, func() {}
+}
+
+func newTestWheel() (*wheel, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	return newWheel(&config.Config{Clock: clock, TimerResolution: time.Second}), clock
+}
+
+func TestWheelFiresAcrossLevels(t *testing.T) {
+	w, clock := newTestWheel()
+	fired := make(map[time.Duration]time.Time)
+	for _, d := range []time.Duration{time.Second, 63 * time.Second, 64 * time.Second, 100 * time.Second, 5000 * time.Second, 300000 * time.Second} {
+		d := d
+		w.reset(newTimer(func() { fired[d] = clock.now }), d)
+	}
+	start := clock.now
+	for i := 0; i < 300001; i++ {
+		clock.now = clock.now.Add(time.Second)
+		w.advance(clock.now)
+	}
+	assert.Len(t, fired, 6)
+	for d, at := range fired {
+		assert.Equal(t, d, at.Sub(start), d.String())
+	}
+}
+
+func TestWheelStopAndReset(t *testing.T) {
+	w, clock := newTestWheel()
+	count := 0
+	stopped := newTimer(func() { count++ })
+	w.reset(stopped, 2*time.Second)
+	w.stop(stopped)
+
+	var repeating *timer
+	repeating = newTimer(func() {
+		count += 10
+		w.reset(repeating, 2*time.Second)
+	})
+	w.reset(repeating, 2*time.Second)
+
+	// a late advance runs the timer once, it repeats from then on
+	clock.now = clock.now.Add(7 * time.Second)
+	w.advance(clock.now)
+	assert.Equal(t, 10, count)
+	clock.now = clock.now.Add(time.Second)
+	w.advance(clock.now)
+	assert.Equal(t, 10, count)
+	clock.now = clock.now.Add(time.Second)
+	w.advance(clock.now)
+	assert.Equal(t, 20, count)
+}
+
+// newTimersTestSession returns the session, its socket, the clock of the wheel and the errors reported so far.
+// A timeout is handled in a goroutine, wait for the socket to close before checking the errors.
+func newTimersTestSession(conf func(*config.Config)) (*Session, *closeCountingAdapter, *fakeClock, func() []error) {
+	s := newBroadcastTestSoket()
+	s.wheel, _ = newTestWheel()
+	clock := s.wheel.clock.(*fakeClock)
+	s.Config.PingPeriod = 10 * time.Second
+	s.Config.PongPeriod = 30 * time.Second
+	conf(s.Config)
+	var errs []error
+	var errsMutex sync.Mutex
+	s.handlers.errorHandler = func(session *Session, err error) {
+		errsMutex.Lock()
+		defer errsMutex.Unlock()
+		errs = append(errs, err)
+	}
+	s.handlers.pongHandler = func(*Session, string) {}
+	s.handlers.receivedTextMessageHandler = func(*Session, []byte) {}
+	session := newBroadcastTestSession(s, "1", 5)
+	adapter := &closeCountingAdapter{}
+	session.socketAdapter = adapter
+	session.startTimers()
+	return session, adapter, clock, func() []error {
+		errsMutex.Lock()
+		defer errsMutex.Unlock()
+		return errs
+	}
+}
+
+func advance(s *Session, clock *fakeClock, d time.Duration) {
+	for end := clock.now.Add(d); clock.now.Before(end); {
+		clock.now = clock.now.Add(time.Second)
+		s.soket.wheel.advance(clock.now)
+	}
+}
+
+func TestSessionPingsAndPongTimeout(t *testing.T) {
+	session, adapter, clock, errs := newTimersTestSession(func(*config.Config) {})
+
+	advance(session, clock, 10*time.Second)
+	assert.Len(t, session.controlQueue, 1)
+	assert.Equal(t, websocket.PingMessage, (<-session.controlQueue).eType)
+
+	advance(session, clock, 15*time.Second)
+	pong(session)
+	advance(session, clock, 20*time.Second)
+	assert.Equal(t, 0, adapter.count())
+
+	advance(session, clock, 10*time.Second)
+	assert.Eventually(t, func() bool { return adapter.count() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []error{ErrPongTimeout}, errs())
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	session, adapter, clock, errs := newTimersTestSession(func(c *config.Config) {
+		c.PingPeriod = 0
+		c.PongPeriod = 0
+		c.IdleTimeout = 5 * time.Second
+	})
+
+	advance(session, clock, 4*time.Second)
+	session.received(websocket.TextMessage, []byte("hi"))
+	advance(session, clock, 4*time.Second)
+	assert.Equal(t, 0, adapter.count())
+	advance(session, clock, 2*time.Second)
+	assert.Eventually(t, func() bool { return adapter.count() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []error{ErrIdleTimeout}, errs())
+	assert.Empty(t, session.controlQueue)
+}
+
+func TestStoppedTimersDoNotFire(t *testing.T) {
+	session, adapter, clock, errs := newTimersTestSession(func(*config.Config) {})
+	session.stopTimers()
+	advance(session, clock, time.Minute)
+	assert.Equal(t, 0, adapter.count())
+	assert.Empty(t, errs())
+	assert.Empty(t, session.controlQueue)
+}
+
+// pong runs the pong handler the session gives its socket.
+func pong(session *Session) {
+	pongWithPayload(session, "")
+}
+
+func pongWithPayload(session *Session, payload string) {
+	adapter := &pongAdapter{}
+	socket := session.socketAdapter
+	session.socketAdapter = adapter
+	session.prepareRead()
+	session.socketAdapter = socket
+	adapter.pongHandler(payload)
+}
+
+type pongAdapter struct {
+	mockAdapter
+	pongHandler func(string) error
+}
+
+func (p *pongAdapter) SetPongHandler(h func(appData string) error) {
+	p.pongHandler = h
+}
+
+func TestTimeoutDoesNotHoldTheWheel(t *testing.T) {
+	session, adapter, clock, _ := newTimersTestSession(func(c *config.Config) {
+		c.PingPeriod = 0
+		c.PongPeriod = 0
+		c.IdleTimeout = 5 * time.Second
+	})
+	release := make(chan struct{})
+	session.soket.handlers.errorHandler = func(*Session, error) {
+		<-release
+	}
+
+	advance(session, clock, 10*time.Second)
+	assert.Equal(t, 0, adapter.count())
+	close(release)
+	assert.Eventually(t, func() bool { return adapter.count() == 1 }, time.Second, time.Millisecond)
+}